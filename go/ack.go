@@ -0,0 +1,186 @@
+package stripelistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Manual ACKs – for Config.DisableAutoACK
+// ---------------------------------------------------------------------------
+
+// ErrNotConnected is returned when writing to the WebSocket while no
+// connection is open.
+var ErrNotConnected = errors.New("not connected")
+
+// ErrMultipleConnections is returned by ACK and ACKV2 on a Listener that
+// holds one connection per feature, for an event the Listener did not read
+// itself, such as one decoded from a log, whose connection is not known.
+var ErrMultipleConnections = errors.New("manual ACK of an event from another source is not supported with several WebSocketFeatures")
+
+// ACK acknowledges a v1 webhook event on the current connection. It is
+// meant for use with DisableAutoACK; writes are serialized with the
+// listener's own. With one connection per feature, the ACK goes out on the
+// connection that delivered the event. It returns ErrNotConnected once the
+// connection the event arrived on has closed, after which Stripe
+// redelivers the event anyway.
+func (l *Listener) ACK(evt WebhookEvent) error {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(evt.EventPayload), &p); err != nil {
+		return fmt.Errorf("ack: decode event id: %w", err)
+	}
+	c, err := l.ackListener(evt.origin)
+	if err != nil {
+		return err
+	}
+	return c.sendACK(p.ID, evt.WebhookConversationID, evt.WebhookID)
+}
+
+// ACKV2 acknowledges a v2 event on the current connection, like ACK.
+func (l *Listener) ACKV2(evt V2Event) error {
+	var p struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(evt.Payload), &p); err != nil {
+		return fmt.Errorf("ack: decode event id: %w", err)
+	}
+	c, err := l.ackListener(evt.origin)
+	if err != nil {
+		return err
+	}
+	return c.sendACK(p.ID, "", evt.EventDestinationID)
+}
+
+// ackListener returns the Listener to ACK an event read by origin on: l
+// itself, or with one connection per feature the child that read it.
+func (l *Listener) ackListener(origin *Listener) (*Listener, error) {
+	l.mu.Lock()
+	children := l.children
+	l.mu.Unlock()
+	if len(children) == 0 {
+		return l, nil
+	}
+	if origin == nil {
+		return nil, ErrMultipleConnections
+	}
+	for _, c := range children {
+		if c == origin {
+			return c, nil
+		}
+	}
+	// Read by a child of an earlier ListenAll, whose connection is gone.
+	return nil, ErrNotConnected
+}
+
+// ---------------------------------------------------------------------------
+// Deferred ACKs – WebhookACKHandler, BatchACKAfterFlush and ACKAfter
+// ---------------------------------------------------------------------------
+
+// deferredACK is the ACK of an event that waits for its handler. With
+// Config.ACKAfter it is also sent once that deadline passes, whichever
+// comes first; after that the handler's outcome no longer matters.
+type deferredACK struct {
+	ack  func()
+	done chan struct{} // closed once settled; nil without ACKAfter
+
+	// With OrderedACKs, settling waits for prev and then closes turn.
+	wait func(prev <-chan struct{})
+	prev <-chan struct{}
+	turn chan struct{}
+
+	mu      sync.Mutex
+	settled bool
+	acked   bool
+}
+
+// deferACK wraps ack for a deferred event and, with ACKAfter, starts its
+// deadline. The deadline is abandoned when ctx ends, as the connection the
+// ACK would go out on is closing.
+func (l *Listener) deferACK(ctx context.Context, eventID string, ack func()) *deferredACK {
+	d := &deferredACK{ack: ack}
+	if l.cfg.OrderedACKs {
+		d.turn = make(chan struct{})
+		l.mu.Lock()
+		d.prev, l.ackTail = l.ackTail, d.turn
+		l.mu.Unlock()
+		d.wait = func(prev <-chan struct{}) {
+			select {
+			case <-prev:
+			case <-l.cfg.Clock.After(l.cfg.OrderedACKWait):
+				l.cfg.Logger.Warnf("earlier ACKs still pending after OrderedACKWait (%s); settling %s out of order", l.cfg.OrderedACKWait, eventID)
+			}
+		}
+	}
+	if l.cfg.ACKAfter <= 0 {
+		return d
+	}
+	d.done = make(chan struct{})
+	go func() {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+		case <-l.cfg.Clock.After(l.cfg.ACKAfter):
+			if d.settle(true) {
+				l.cfg.Logger.Infof("handler for %s still running after ACKAfter (%s); ACKed it", eventID, l.cfg.ACKAfter)
+			}
+		}
+	}()
+	return d
+}
+
+// settle ACKs (ok) or declines the event unless it was settled already, and
+// reports whether this call settled it. With OrderedACKs it first waits,
+// boundedly, for the previous event to be settled.
+func (d *deferredACK) settle(ok bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.settled {
+		return false
+	}
+	d.settled = true
+	if d.done != nil {
+		close(d.done)
+	}
+	if d.turn != nil {
+		defer close(d.turn)
+		if d.prev != nil {
+			d.wait(d.prev)
+		}
+	}
+	if ok {
+		d.ack()
+		d.acked = true
+	}
+	return true
+}
+
+// ackInOrder sends an ACK that doesn't wait for a handler. With
+// OrderedACKs it first waits for the deferred ACKs of earlier events.
+func (l *Listener) ackInOrder(ctx context.Context, eventID string, ack func()) {
+	if !l.cfg.OrderedACKs {
+		ack()
+		return
+	}
+	l.deferACK(ctx, eventID, ack).confirm()
+}
+
+// confirm ACKs the event after its handler succeeded.
+func (d *deferredACK) confirm() { d.settle(true) }
+
+// decline leaves the event un-ACKed after its handler failed. It reports
+// false if the ACKAfter deadline had already ACKed the event, in which case
+// Stripe will not redeliver it. A nil d, for an event ACKed on receipt,
+// reports true as before.
+func (d *deferredACK) decline() bool {
+	if d == nil || d.settle(false) {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.acked
+}
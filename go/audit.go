@@ -0,0 +1,140 @@
+package stripelistener
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// AuditSink – record of every received / acknowledged / skipped event
+// ---------------------------------------------------------------------------
+
+// AuditSink records what happened to each event, separately from
+// operational logs. Methods are called inline from the read loop and must
+// not block; JSONLAuditSink shows how to buffer.
+type AuditSink interface {
+	// RecordReceived is called once an event's payload has been parsed.
+	RecordReceived(evt AuditEvent)
+
+	// RecordAcked is called after the ACK for eventID was written.
+	RecordAcked(eventID string, at time.Time)
+
+	// RecordSkipped is called when an ACKed event is not dispatched.
+	RecordSkipped(eventID string, reason string, at time.Time)
+}
+
+// AuditEvent identifies a received event.
+type AuditEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Kind       string    `json:"kind"` // "webhook_event" or "v2_event"
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+type nopAuditSink struct{}
+
+func (nopAuditSink) RecordReceived(AuditEvent)               {}
+func (nopAuditSink) RecordAcked(string, time.Time)           {}
+func (nopAuditSink) RecordSkipped(string, string, time.Time) {}
+
+// JSONLAuditSink appends audit records to a file, one JSON object per line.
+// Records are queued on a buffered channel and written by a background
+// goroutine; when the queue is full the record is dropped and counted
+// rather than blocking the read loop.
+type JSONLAuditSink struct {
+	f       *os.File
+	w       *bufio.Writer
+	queue   chan auditRecord
+	done    chan struct{}
+	dropped atomic.Int64
+
+	closeOnce sync.Once
+	err       error
+}
+
+type auditRecord struct {
+	Record string    `json:"record"` // "received", "acked" or "skipped"
+	ID     string    `json:"id"`
+	Type   string    `json:"type,omitempty"`
+	Kind   string    `json:"kind,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// NewJSONLAuditSink opens (or creates) path for appending. Call Close to
+// flush pending records.
+func NewJSONLAuditSink(path string) (*JSONLAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s := &JSONLAuditSink{
+		f:     f,
+		w:     bufio.NewWriter(f),
+		queue: make(chan auditRecord, 1024),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *JSONLAuditSink) RecordReceived(evt AuditEvent) {
+	s.enqueue(auditRecord{Record: "received", ID: evt.ID, Type: evt.Type, Kind: evt.Kind, At: evt.ReceivedAt})
+}
+
+func (s *JSONLAuditSink) RecordAcked(eventID string, at time.Time) {
+	s.enqueue(auditRecord{Record: "acked", ID: eventID, At: at})
+}
+
+func (s *JSONLAuditSink) RecordSkipped(eventID string, reason string, at time.Time) {
+	s.enqueue(auditRecord{Record: "skipped", ID: eventID, Reason: reason, At: at})
+}
+
+// Dropped returns how many records were discarded because the queue was full.
+func (s *JSONLAuditSink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close flushes queued records and closes the file. Records must not be
+// submitted after Close.
+func (s *JSONLAuditSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.queue)
+		<-s.done
+		if err := s.w.Flush(); err != nil && s.err == nil {
+			s.err = err
+		}
+		if err := s.f.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+	})
+	return s.err
+}
+
+func (s *JSONLAuditSink) enqueue(r auditRecord) {
+	select {
+	case s.queue <- r:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *JSONLAuditSink) run() {
+	defer close(s.done)
+	enc := json.NewEncoder(s.w)
+	for r := range s.queue {
+		if err := enc.Encode(r); err != nil && s.err == nil {
+			s.err = err
+		}
+		// Flush whenever the queue drains so the file stays current.
+		if len(s.queue) == 0 {
+			if err := s.w.Flush(); err != nil && s.err == nil {
+				s.err = err
+			}
+		}
+	}
+}
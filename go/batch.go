@@ -0,0 +1,102 @@
+package stripelistener
+
+import (
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Batching – hand v1 events to the handler in groups
+// ---------------------------------------------------------------------------
+
+// BatchHandler is optionally implemented by a handler. When it is and
+// Config.BatchSize > 0, v1 webhook events are collected and passed to
+// OnBatch instead of OnWebhookEvent, once BatchSize events are buffered or
+// BatchMaxWait after the first one arrived, whichever comes first. Events
+// still buffered when Listen stops are flushed before it returns.
+//
+// OnBatch runs on a single goroutine, one batch at a time, and receives
+// events in the order they were read. While it runs, the next batch fills
+// up until BatchSize events are waiting, then reading pauses.
+type BatchHandler interface {
+	// OnBatch handles a batch. Its error only matters with
+	// Config.BatchACKAfterFlush, where it leaves the whole batch un-ACKed.
+	OnBatch(events []WebhookEvent) error
+}
+
+type batchItem struct {
+	evt WebhookEvent
+	id  string
+	ack *deferredACK // nil when the event was ACKed on receipt
+}
+
+// runBatcher collects items from in and flushes them to h until in is
+// closed, then flushes what is left.
+func (l *Listener) runBatcher(in <-chan batchItem, h BatchHandler) {
+	var (
+		buf   []batchItem
+		timer <-chan time.Time
+	)
+	flush := func() {
+		timer = nil
+		if len(buf) == 0 {
+			return
+		}
+		batch := buf
+		buf = nil
+		l.flushBatch(h, batch)
+	}
+
+	for {
+		select {
+		case it, ok := <-in:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, it)
+			if len(buf) == 1 {
+				timer = l.cfg.Clock.After(l.cfg.BatchMaxWait)
+			}
+			if len(buf) >= l.cfg.BatchSize {
+				flush()
+			}
+		case <-timer:
+			flush()
+		}
+	}
+}
+
+func (l *Listener) flushBatch(h BatchHandler, batch []batchItem) {
+	events := make([]WebhookEvent, len(batch))
+	for i, it := range batch {
+		events[i] = it.evt
+	}
+
+	start := time.Now()
+	err := h.OnBatch(events)
+	l.cfg.Metrics.ObserveHandlerDuration(time.Since(start))
+
+	if !l.cfg.BatchACKAfterFlush {
+		if err != nil {
+			l.cfg.Logger.Warnf("batch of %d events failed: %v", len(batch), err)
+		}
+		return
+	}
+	if err != nil {
+		l.cfg.Logger.Infof("not acking batch of %d events, Stripe will redeliver them: %v", len(batch), err)
+		for _, it := range batch {
+			if it.ack.decline() {
+				l.forgetDuplicate(it.id)
+				l.inflight.remove(it.evt.WebhookConversationID)
+			} else {
+				l.cfg.Logger.Warnf("%s was already ACKed after ACKAfter; Stripe will not redeliver it", it.id)
+			}
+		}
+		return
+	}
+	for _, it := range batch {
+		if it.ack != nil {
+			it.ack.confirm()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package stripelistener
+
+import "sync"
+
+// ---------------------------------------------------------------------------
+// Recent events – in-memory ring buffer for debugging (Config.BufferSize)
+// ---------------------------------------------------------------------------
+
+type eventRing struct {
+	mu   sync.Mutex
+	buf  []WebhookEvent
+	next int
+	full bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{buf: make([]WebhookEvent, size)}
+}
+
+func (r *eventRing) add(evt WebhookEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = evt
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the buffered events, oldest first.
+func (r *eventRing) snapshot() []WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]WebhookEvent(nil), r.buf[:r.next]...)
+	}
+	out := make([]WebhookEvent, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// RecentEvents returns a copy of the last Config.BufferSize v1 webhook
+// events received, oldest first, whether or not they were dispatched. It
+// returns nil when BufferSize is zero. Safe to call concurrently with
+// Listen.
+func (l *Listener) RecentEvents() []WebhookEvent {
+	if l.recent == nil {
+		return nil
+	}
+	return l.recent.snapshot()
+}
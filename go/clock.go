@@ -0,0 +1,35 @@
+package stripelistener
+
+import "time"
+
+// ---------------------------------------------------------------------------
+// Clock – time source for keepalive, deadlines and backoff
+// ---------------------------------------------------------------------------
+
+// Clock abstracts the time functions the listener uses, so tests can drive
+// pings, deadlines and backoff without real sleeps.
+//
+// Now is also used to compute socket read and write deadlines, so a fake
+// clock used with a real connection must stay close to wall-clock time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the subset of *time.Ticker the listener uses.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,157 @@
+package stripelistener_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	sl "github.com/kmoz000/stripelistener/go"
+	"github.com/kmoz000/stripelistener/go/testutil"
+)
+
+// fakeClock is a Clock whose timers and tickers only fire when the test
+// calls Advance. Now stays close to wall-clock time, as Clock requires,
+// plus however far the clock has been advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	elapsed time.Duration
+	timers  []*fakeTimer
+}
+
+type fakeTimer struct {
+	d      time.Duration
+	due    time.Duration // in fakeClock.elapsed
+	period time.Duration // > 0 for tickers
+	ch     chan time.Time
+	done   bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Add(c.elapsed)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) sl.Ticker {
+	return fakeTicker{c, c.add(d, d)}
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{d: d, due: c.elapsed + d, period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		t.ch <- time.Now().Add(c.elapsed)
+		t.done = true
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elapsed += d
+	now := time.Now().Add(c.elapsed)
+	for _, t := range c.timers {
+		for !t.done && t.due <= c.elapsed {
+			select {
+			case t.ch <- now:
+			default: // like time.Ticker, drop ticks nobody read
+			}
+			if t.period == 0 {
+				t.done = true
+			} else {
+				t.due += t.period
+			}
+		}
+	}
+}
+
+// waitTimer waits until a timer of at least min and at most max is pending
+// and returns its duration.
+func (c *fakeClock) waitTimer(t *testing.T, what string, min, max time.Duration) time.Duration {
+	t.Helper()
+	var d time.Duration
+	waitFor(t, what, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, tm := range c.timers {
+			if !tm.done && tm.period == 0 && tm.d >= min && tm.d <= max {
+				d = tm.d
+				return true
+			}
+		}
+		return false
+	})
+	return d
+}
+
+type fakeTicker struct {
+	c *fakeClock
+	t *fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.ch }
+
+func (t fakeTicker) Stop() {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	t.t.done = true
+}
+
+func TestFakeClockDrivesPings(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	clock := &fakeClock{}
+	cfg.Handler = &recorder{}
+	cfg.Clock = clock
+	l := sl.New(cfg)
+	stop := listen(t, l)
+	defer stop()
+
+	clock.waitTimer(t, "the ping timer", sl.DefaultPingPeriod, sl.DefaultPingPeriod)
+	clock.Advance(sl.DefaultPingPeriod - time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if n := l.Stats().PingsSent; n != 0 {
+		t.Fatalf("%d pings sent before PingPeriod elapsed", n)
+	}
+	clock.Advance(time.Millisecond)
+	waitFor(t, "the first ping", func() bool { return l.Stats().PingsSent == 1 })
+	waitFor(t, "its pong", func() bool { return !l.LastPong().IsZero() })
+
+	clock.waitTimer(t, "the next ping timer", sl.DefaultPingPeriod, sl.DefaultPingPeriod)
+	clock.Advance(sl.DefaultPingPeriod)
+	waitFor(t, "the second ping", func() bool { return l.Stats().PingsSent == 2 })
+}
+
+func TestFakeClockDrivesBackoff(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	clock := &fakeClock{}
+	cfg.Handler = &recorder{}
+	cfg.Clock = clock
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	waitFor(t, "the first connection", func() bool { return srv.OpenConnections() == 1 })
+	srv.Disconnect(ws.CloseGoingAway, "bye")
+
+	// The mock session's reconnect_delay is 1s, jittered down by up to half.
+	wait := clock.waitTimer(t, "the backoff timer", 500*time.Millisecond, time.Second)
+	clock.Advance(wait - time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if n := srv.Sessions(); n != 1 {
+		t.Fatalf("reconnected before the %v backoff elapsed (%d sessions)", wait, n)
+	}
+	clock.Advance(time.Millisecond)
+	waitFor(t, "the reconnect", func() bool { return srv.Sessions() == 2 && srv.OpenConnections() == 1 })
+}
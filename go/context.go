@@ -0,0 +1,88 @@
+package stripelistener
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Context values – event ID and type for correlation in handlers
+// ---------------------------------------------------------------------------
+
+type contextKey string
+
+// Context keys under which the ctx passed to EventHandlerContext and
+// WebhookACKHandler methods carries the event's ID and type, both strings.
+var (
+	ContextKeyEventID   = contextKey("stripelistener.event_id")
+	ContextKeyEventType = contextKey("stripelistener.event_type")
+)
+
+// ContextKeyAccountID is the context key under which handler contexts carry
+// the listener's AccountID, a string, identifying the account the event
+// came from.
+var ContextKeyAccountID = contextKey("stripelistener.account_id")
+
+func withEvent(ctx context.Context, id, eventType string) context.Context {
+	ctx = context.WithValue(ctx, ContextKeyEventID, id)
+	return context.WithValue(ctx, ContextKeyEventType, eventType)
+}
+
+// EventIDFromContext returns the ID of the event being handled, or "".
+func EventIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ContextKeyEventID).(string)
+	return id
+}
+
+// EventTypeFromContext returns the type of the event being handled, or "".
+func EventTypeFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(ContextKeyEventType).(string)
+	return t
+}
+
+func withAccount(ctx context.Context, accountID string) context.Context {
+	if accountID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, ContextKeyAccountID, accountID)
+}
+
+// AccountIDFromContext returns the AccountID of the listener that received
+// the event being handled, or "".
+func AccountIDFromContext(ctx context.Context) string {
+	a, _ := ctx.Value(ContextKeyAccountID).(string)
+	return a
+}
+
+// ---------------------------------------------------------------------------
+// Handler deadlines – Config.HandlerTimeout and HandlerTimeouts
+// ---------------------------------------------------------------------------
+
+// handlerContext returns the ctx for a handler of the given event: ctx with
+// the event's ID and type and, if one applies, a deadline.
+func (l *Listener) handlerContext(ctx context.Context, id, eventType string) (context.Context, context.CancelFunc) {
+	ctx = withEvent(ctx, id, eventType)
+	if d := l.handlerTimeout(eventType); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+// handlerTimeout picks the deadline for eventType: an exact HandlerTimeouts
+// key, else the longest matching pattern, else HandlerTimeout.
+func (l *Listener) handlerTimeout(eventType string) time.Duration {
+	if d, ok := l.cfg.HandlerTimeouts[eventType]; ok && !strings.Contains(eventType, "*") {
+		return d
+	}
+	best, d := "", l.cfg.HandlerTimeout
+	for p, pd := range l.cfg.HandlerTimeouts {
+		if !strings.Contains(p, "*") || !matchType(p, eventType) {
+			continue
+		}
+		if best == "" || len(p) > len(best) || len(p) == len(best) && p < best {
+			best, d = p, pd
+		}
+	}
+	return d
+}
@@ -0,0 +1,86 @@
+package stripelistener
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Dedup – drop redelivered event IDs seen within Config.DedupWindow
+// ---------------------------------------------------------------------------
+
+// dedupCache is a bounded LRU of recently seen event IDs. It lives on the
+// Listener, so it also spans reconnects.
+type dedupCache struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	order  *list.List // front = most recently seen
+	byID   map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newDedupCache(window time.Duration, size int) *dedupCache {
+	return &dedupCache{
+		window: window,
+		size:   size,
+		order:  list.New(),
+		byID:   make(map[string]*list.Element),
+	}
+}
+
+// seen records id and reports whether it was already seen within the
+// window. The window is measured from the first delivery.
+func (c *dedupCache) seen(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.byID[id]; ok {
+		e := el.Value.(*dedupEntry)
+		if now.Sub(e.seen) < c.window {
+			c.order.MoveToFront(el)
+			return true
+		}
+		e.seen = now
+		c.order.MoveToFront(el)
+		return false
+	}
+
+	c.byID[id] = c.order.PushFront(&dedupEntry{id: id, seen: now})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.byID, oldest.Value.(*dedupEntry).id)
+	}
+	return false
+}
+
+// forget removes id, so its next delivery is not treated as a duplicate.
+func (c *dedupCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.byID[id]; ok {
+		c.order.Remove(el)
+		delete(c.byID, id)
+	}
+}
+
+// duplicate reports whether eventID should be dropped as a redelivery.
+func (l *Listener) duplicate(eventID string) bool {
+	if l.dedup == nil || eventID == "" {
+		return false
+	}
+	return l.dedup.seen(eventID, l.cfg.Clock.Now())
+}
+
+// forgetDuplicate undoes duplicate for an event that was not ACKed.
+func (l *Listener) forgetDuplicate(eventID string) {
+	if l.dedup != nil && eventID != "" {
+		l.dedup.forget(eventID)
+	}
+}
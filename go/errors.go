@@ -0,0 +1,63 @@
+package stripelistener
+
+import "fmt"
+
+// ---------------------------------------------------------------------------
+// Non-fatal errors – surfaced on Config.Errors
+// ---------------------------------------------------------------------------
+
+// ACKError reports that the ACK for an event could not be sent. Stripe will
+// redeliver the event.
+type ACKError struct {
+	EventID string
+	Err     error
+}
+
+func (e *ACKError) Error() string {
+	return fmt.Sprintf("ack %s: %v", e.EventID, e.Err)
+}
+
+func (e *ACKError) Unwrap() error { return e.Err }
+
+// MalformedMessageError reports a frame that could not be decoded. Kind is
+// the message type ("webhook_event" or "v2_event") when only the embedded
+// payload was malformed, and empty when the frame itself was not valid JSON.
+type MalformedMessageError struct {
+	Kind string
+	Data []byte
+	Err  error
+}
+
+func (e *MalformedMessageError) Error() string {
+	if e.Kind == "" {
+		return fmt.Sprintf("malformed message: %v", e.Err)
+	}
+	return fmt.Sprintf("malformed %s payload: %v", e.Kind, e.Err)
+}
+
+func (e *MalformedMessageError) Unwrap() error { return e.Err }
+
+// ConnectionClosedError is returned by Listen when the server closed the
+// WebSocket with a close code other than 1000 (normal closure, for which
+// Listen returns nil). Code is one of the ws.Close* constants, e.g.
+// 1001 going away, 1006 abnormal closure or 1008 policy violation.
+type ConnectionClosedError struct {
+	Code int
+	Text string
+}
+
+func (e *ConnectionClosedError) Error() string {
+	return fmt.Sprintf("connection closed by server: code %d %s", e.Code, e.Text)
+}
+
+// reportError offers err to Config.Errors without blocking.
+func (l *Listener) reportError(err error) {
+	if l.cfg.Errors == nil {
+		return
+	}
+	select {
+	case l.cfg.Errors <- err:
+	default:
+		l.cfg.Logger.Warnf("errors channel full; dropped: %v", err)
+	}
+}
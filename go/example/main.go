@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	sl "github.com/kmoz000/stripelistener/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // stdLogger adapts Go's log package to the Logger interface.
@@ -51,10 +54,19 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() { <-sig; cancel() }()
 
+	// Optional: expose Prometheus metrics, e.g. METRICS_ADDR=:9090
+	var metrics sl.Metrics
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metrics = newPromMetrics(prometheus.DefaultRegisterer)
+		http.Handle("/metrics", promhttp.Handler())
+		go func() { log.Println(http.ListenAndServe(addr, nil)) }()
+	}
+
 	listener := sl.New(sl.Config{
 		APIKey:  key,
 		Handler: handler{},
 		Logger:  stdLogger{},
+		Metrics: metrics,
 	})
 
 	// One-liner: authorize → connect → listen
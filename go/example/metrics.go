@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promMetrics adapts the listener's Metrics interface to Prometheus
+// collectors. Register it once and expose it with promhttp.Handler().
+type promMetrics struct {
+	events     *prometheus.CounterVec
+	handler    prometheus.Histogram
+	reconnects prometheus.Counter
+	ackFails   prometheus.Counter
+}
+
+func newPromMetrics(reg prometheus.Registerer) *promMetrics {
+	m := &promMetrics{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stripelistener_events_total",
+			Help: "Stripe events received, by event type.",
+		}, []string{"type"}),
+		handler: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "stripelistener_handler_duration_seconds",
+			Help:    "Time spent in the event handler.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stripelistener_reconnects_total",
+			Help: "Reconnection attempts.",
+		}),
+		ackFails: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stripelistener_ack_failures_total",
+			Help: "Event ACKs that could not be sent.",
+		}),
+	}
+	reg.MustRegister(m.events, m.handler, m.reconnects, m.ackFails)
+	return m
+}
+
+func (m *promMetrics) IncEvent(eventType string) { m.events.WithLabelValues(eventType).Inc() }
+func (m *promMetrics) ObserveHandlerDuration(d time.Duration) {
+	m.handler.Observe(d.Seconds())
+}
+func (m *promMetrics) IncReconnect()  { m.reconnects.Inc() }
+func (m *promMetrics) IncACKFailure() { m.ackFails.Inc() }
@@ -0,0 +1,130 @@
+package stripelistener
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// One connection per WebSocket feature
+// A session authorizes a single feature, so listening to e.g. both
+// "webhooks" and "request_logs" takes one session and connection each.
+// ---------------------------------------------------------------------------
+
+// Sessions returns the current session for each feature, keyed by the
+// requested feature name. With a single feature it holds just Session().
+func (l *Listener) Sessions() map[string]*Session {
+	l.mu.Lock()
+	children := l.children
+	l.mu.Unlock()
+
+	out := make(map[string]*Session)
+	if len(children) == 0 {
+		if s := l.Session(); s != nil {
+			out[l.cfg.WebSocketFeatures[0]] = s
+		}
+		return out
+	}
+	for _, c := range children {
+		if s := c.Session(); s != nil {
+			out[c.cfg.WebSocketFeatures[0]] = s
+		}
+	}
+	return out
+}
+
+// forFeature returns a Listener for a single feature that shares this
+// Listener's handler, filters, dedup cache, buffers and counters.
+func (l *Listener) forFeature(feature string) *Listener {
+	cfg := l.cfg
+	cfg.WebSocketFeatures = []string{feature}
+	return &Listener{
+		cfg:          cfg,
+		cfgErr:       l.cfgErr,
+		handler:      l.handler,
+		accounts:     l.accounts,
+		destinations: l.destinations,
+		stats:        l.stats,
+		trace:        l.trace,
+		dedup:        l.dedup,
+		recent:       l.recent,
+		sink:         l.sink,
+		paused:       l.paused,
+		apiKey:       l.apiKey,
+		limiter:      l.limiter,
+		eventCount:   l.eventCount,
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// listenPerFeature runs run on one child Listener per feature. The first
+// child to return stops the others, and its error is returned.
+func (l *Listener) listenPerFeature(ctx context.Context, run func(*Listener, context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	children := make([]*Listener, len(l.cfg.WebSocketFeatures))
+	for i, f := range l.cfg.WebSocketFeatures {
+		children[i] = l.forFeature(f)
+	}
+	l.mu.Lock()
+	l.children = children
+	l.mu.Unlock()
+
+	go func() {
+		for _, c := range children {
+			select {
+			case <-c.ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+		l.markReady()
+	}()
+
+	errCh := make(chan error, len(children))
+	var wg sync.WaitGroup
+	for _, c := range children {
+		wg.Add(1)
+		go func(c *Listener) {
+			defer wg.Done()
+			errCh <- run(c, ctx)
+		}(c)
+	}
+
+	err := <-errCh
+	cancel()
+	wg.Wait()
+	if err == nil || errors.Is(err, context.Canceled) {
+		// Prefer a sibling's real error over our own cancellation.
+		close(errCh)
+		for e := range errCh {
+			if e != nil && !errors.Is(e, context.Canceled) {
+				err = e
+				break
+			}
+		}
+	}
+	return err
+}
+
+// AuthorizedFeatures returns the features Stripe authorized, parsed from
+// each session's websocket_authorized_feature, which may list several
+// features separated by commas. It is empty before Authorize. Compare it
+// with WebSocketFeatures to validate the configuration at startup.
+func (l *Listener) AuthorizedFeatures() []string {
+	var out []string
+	for _, s := range l.Sessions() {
+		for _, f := range strings.Split(s.WebSocketAuthorizedFeature, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				out = append(out, f)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,86 @@
+package stripelistener
+
+import "strings"
+
+// ---------------------------------------------------------------------------
+// Event filters
+// ---------------------------------------------------------------------------
+
+// matchType reports whether an event type matches pattern. A pattern is an
+// exact type ("charge.refunded"), a prefix ending in '*' ("payment_intent.*"),
+// a suffix starting with '*' ("*.deleted"), or "*" for everything.
+func matchType(pattern, eventType string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(eventType, strings.TrimPrefix(pattern, "*"))
+	default:
+		return pattern == eventType
+	}
+}
+
+// acceptType reports whether eventType passes Config.EventTypes.
+func (l *Listener) acceptType(eventType string) bool {
+	if len(l.cfg.EventTypes) == 0 {
+		return true
+	}
+	for _, p := range l.cfg.EventTypes {
+		if matchType(p, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipWebhook applies the dedup cache and filters to a v1 event. It returns
+// the reason the event must not be dispatched, or "" to dispatch it.
+func (l *Listener) skipWebhook(parsed StripeEventPayload) string {
+	switch {
+	case l.duplicate(parsed.ID):
+		l.cfg.Logger.Debugf("dropping duplicate %s", parsed.ID)
+		return "duplicate"
+	case !l.acceptLivemode(parsed.Livemode):
+		l.cfg.Logger.Debugf("skipping %s with livemode=%t", parsed.ID, parsed.Livemode)
+		return "livemode filter"
+	case !l.acceptAccount(parsed.Account):
+		l.cfg.Logger.Debugf("skipping %s for account %q", parsed.ID, parsed.Account)
+		return "account filter"
+	case !l.acceptType(parsed.Type):
+		l.cfg.Logger.Debugf("skipping %s of type %s", parsed.ID, parsed.Type)
+		return "event type filter"
+	}
+	return ""
+}
+
+// acceptLivemode reports whether an event with the given livemode passes
+// Config.LiveModeOnly.
+func (l *Listener) acceptLivemode(livemode bool) bool {
+	return l.cfg.LiveModeOnly == nil || *l.cfg.LiveModeOnly == livemode
+}
+
+// acceptAccount reports whether events for account pass Accounts and
+// AccountFilter.
+func (l *Listener) acceptAccount(account string) bool {
+	if l.accounts != nil {
+		if _, ok := l.accounts[account]; !ok {
+			return false
+		}
+	}
+	if l.cfg.AccountFilter != nil && !l.cfg.AccountFilter(account) {
+		return false
+	}
+	return true
+}
+
+// acceptDestination reports whether a v2 event from the given event
+// destination passes Config.DestinationIDs.
+func (l *Listener) acceptDestination(id string) bool {
+	if l.destinations == nil {
+		return true
+	}
+	_, ok := l.destinations[id]
+	return ok
+}
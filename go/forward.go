@@ -0,0 +1,97 @@
+package stripelistener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// maxForwardResponseBody caps how much of the local endpoint's response
+// body is reported back to Stripe.
+const maxForwardResponseBody = 64 << 10
+
+// ---------------------------------------------------------------------------
+// Forwarding – POST webhook events to a local endpoint, like
+// `stripe listen --forward-to`
+// Source: https://github.com/stripe/stripe-cli/blob/master/pkg/proxy/endpoint.go
+// ---------------------------------------------------------------------------
+
+// forward POSTs the raw event payload to Config.ForwardTo, replaying the
+// headers Stripe attached to the event and signing it with secret. It runs
+// on its own goroutine so a slow local server can't stall the read loop.
+// ctx is Listen's, which ends the request when Listen returns, and conn is
+// the connection the event arrived on.
+func (l *Listener) forward(ctx context.Context, conn *ws.Conn, evt WebhookEvent, eventID, secret string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.cfg.ForwardTo, strings.NewReader(evt.EventPayload))
+	if err != nil {
+		l.cfg.Logger.Warnf("forward %s: %v", eventID, err)
+		return
+	}
+	for k, v := range evt.HTTPHeaders {
+		req.Header.Set(k, v)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if secret != "" {
+		req.Header.Set("Stripe-Signature", signatureHeader(l.cfg.Clock.Now(), []byte(evt.EventPayload), secret))
+	}
+
+	resp, err := l.cfg.ForwardHTTPClient.Do(req)
+	if err != nil {
+		l.cfg.Logger.Warnf("forward %s to %s: %v", eventID, l.cfg.ForwardTo, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxForwardResponseBody))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		l.cfg.Logger.Warnf("forward %s to %s: HTTP %d", eventID, l.cfg.ForwardTo, resp.StatusCode)
+	} else {
+		l.cfg.Logger.Infof("forwarded %s to %s [%d]", eventID, l.cfg.ForwardTo, resp.StatusCode)
+	}
+
+	err = l.sendWebhookResponse(conn, WebhookResponse{
+		ForwardURL:            l.cfg.ForwardTo,
+		Status:                resp.StatusCode,
+		HTTPHeaders:           flattenHeader(resp.Header),
+		Body:                  string(body),
+		Type:                  MsgTypeWebhookResponse,
+		WebhookConversationID: evt.WebhookConversationID,
+		WebhookID:             evt.WebhookID,
+		RequestHeaders:        flattenHeader(req.Header),
+		RequestBody:           evt.EventPayload,
+	})
+	if err != nil {
+		l.cfg.Logger.Warnf("webhook_response for %s not sent: %v", eventID, err)
+	}
+}
+
+// sendWebhookResponse reports a forward's outcome to Stripe on conn, like
+// the Stripe CLI does after each forward. forward runs on the Listener that
+// read the event, so with one connection per feature this is that
+// feature's connection. After a reconnect the response is dropped with
+// ErrNotConnected: its conversation belonged to the old connection. Failed
+// forwards that got no response at all are not reported, as in the CLI.
+func (l *Listener) sendWebhookResponse(conn *ws.Conn, r WebhookResponse) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return l.writeMessageTo(conn, ws.TextMessage, data)
+}
+
+// flattenHeader turns h into the single-valued map the protocol uses,
+// joining repeated headers with commas.
+func flattenHeader(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, vs := range h {
+		m[k] = strings.Join(vs, ",")
+	}
+	return m
+}
@@ -2,4 +2,7 @@ module github.com/kmoz000/stripelistener/go
 
 go 1.21
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/time v0.5.0
+)
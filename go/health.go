@@ -0,0 +1,128 @@
+package stripelistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Health – liveness as seen by the ping/pong keepalive
+// ---------------------------------------------------------------------------
+
+// LastPong returns when the last pong was received on the current
+// connection, or the zero time if none has been received yet. With one connection per feature it is the
+// oldest of the connections' last pongs.
+func (l *Listener) LastPong() time.Time {
+	l.mu.Lock()
+	children := l.children
+	l.mu.Unlock()
+	if len(children) > 0 {
+		var oldest time.Time
+		for i, c := range children {
+			if t := c.LastPong(); i == 0 || t.Before(oldest) {
+				oldest = t
+			}
+		}
+		return oldest
+	}
+
+	return unixNano(l.lastPong.Load())
+}
+
+// Healthy reports whether the WebSocket is connected and a pong arrived
+// within PongWait. The first pong answers the first ping, sent PingPeriod
+// after connecting, so a liveness probe should allow at least that long
+// before its first check.
+func (l *Listener) Healthy() bool {
+	l.mu.Lock()
+	children := l.children
+	l.mu.Unlock()
+	if len(children) > 0 {
+		for _, c := range children {
+			if !c.Healthy() {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !l.connected() {
+		return false
+	}
+	last := l.LastPong()
+	return !last.IsZero() && l.cfg.Clock.Now().Sub(last) < l.cfg.PongWait
+}
+
+// WaitReady blocks until Connect has succeeded once, or ctx is done. With
+// one connection per feature it waits for every feature to connect. It
+// does not track later disconnects; use Healthy for that.
+func (l *Listener) WaitReady(ctx context.Context) error {
+	select {
+	case <-l.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Listener) markReady() {
+	l.readyOnce.Do(func() { close(l.ready) })
+}
+
+// Done returns a channel that is closed when Listen, ListenAll or
+// ListenWithReconnect returns, for selecting on alongside other work. It
+// is closed only once: a later call on the same Listener does not reopen
+// it. Inside ListenWithReconnect, the individual reconnects do not close it.
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns the error the call that closed Done returned, which may be
+// nil. It is nil while Done is open.
+func (l *Listener) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.doneErr
+}
+
+// finish records err as the Listener's outcome and closes Done, once.
+func (l *Listener) finish(err error) {
+	l.doneOnce.Do(func() {
+		l.mu.Lock()
+		l.doneErr = err
+		l.mu.Unlock()
+		close(l.done)
+	})
+}
+
+// ErrIdleTimeout is wrapped by the error Listen returns when MaxIdle
+// elapsed without any message or pong.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// idleWatchdog returns an error once MaxIdle has passed without activity,
+// or nil when ctx is done.
+func (l *Listener) idleWatchdog(ctx context.Context) error {
+	// Check four times per MaxIdle, but no more than once a millisecond;
+	// a tiny MaxIdle would otherwise round the interval down to zero.
+	interval := l.cfg.MaxIdle / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := l.cfg.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C():
+			idle := now.Sub(unixNano(l.lastActivity.Load()))
+			if idle >= l.cfg.MaxIdle {
+				l.systemEvent(SystemEventStalled, map[string]interface{}{"idle": idle})
+				return fmt.Errorf("no message or pong for %s: %w", idle.Round(time.Millisecond), ErrIdleTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package stripelistener
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// In-flight conversations – received but not yet ACKed
+// ---------------------------------------------------------------------------
+
+// inflightSet tracks the webhook conversations of one connection from
+// receipt until their ACK is written or the handler declines them.
+type inflightSet struct {
+	mu    sync.Mutex
+	since map[string]time.Time
+}
+
+func (s *inflightSet) add(conversationID string, at time.Time) {
+	if conversationID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.since == nil {
+		s.since = make(map[string]time.Time)
+	}
+	s.since[conversationID] = at
+}
+
+func (s *inflightSet) remove(conversationID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.since, conversationID)
+}
+
+// clear forgets every conversation, for when the connection closes and
+// Stripe will redeliver whatever was left un-ACKed.
+func (s *inflightSet) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = nil
+}
+
+// InFlight returns the WebhookConversationIDs of v1 events that have been
+// received on the current connection but not yet ACKed, oldest first. With
+// the default automatic ACKs this is usually empty, since events are ACKed
+// before their handler runs; it fills with events waiting on a
+// WebhookACKHandler, a BatchACKAfterFlush batch or, with DisableAutoACK, a
+// call to ACK. A conversation is dropped when its ACK is written, when its
+// handler declines it, or when the connection closes.
+func (l *Listener) InFlight() []string {
+	l.mu.Lock()
+	children := l.children
+	l.mu.Unlock()
+
+	type entry struct {
+		id string
+		at time.Time
+	}
+	var all []entry
+	collect := func(s *inflightSet) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for id, at := range s.since {
+			all = append(all, entry{id, at})
+		}
+	}
+	if len(children) > 0 {
+		for _, c := range children {
+			collect(&c.inflight)
+		}
+	} else {
+		collect(&l.inflight)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].at.Before(all[j].at) })
+	ids := make([]string, len(all))
+	for i, e := range all {
+		ids[i] = e.id
+	}
+	return ids
+}
@@ -2,17 +2,27 @@ package stripelistener
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ws "github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
 )
 
 // ---------------------------------------------------------------------------
@@ -26,8 +36,13 @@ const (
 	DefaultWriteWait     = 1 * time.Second
 	DefaultReconnectWait = 10 * time.Second
 
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	DefaultMaxReconnectWait = 2 * time.Minute
+	DefaultMaxMessageBytes  = 1 << 20 // 1 MiB
+	DefaultOrderedACKWait   = 10 * time.Second
+
 	cliVersion  = "1.21.0"
-	subprotocol = "stripecli-devproxy-v1"
 	sessionPath = "/v1/stripecli/sessions"
 	apiBase     = "https://api.stripe.com"
 )
@@ -48,24 +63,152 @@ type EventHandler interface {
 	OnUnknownMessage(rawType string, data json.RawMessage)
 }
 
+// EventErrorHandler is optionally implemented by a handler. When it is, a
+// v1 event whose EventPayload fails to parse is delivered to OnEventError
+// instead of OnWebhookEvent with a zero-valued payload.
+type EventErrorHandler interface {
+	OnEventError(raw WebhookEvent, parseErr error)
+}
+
+// EventHandlerContext is the context-aware variant of EventHandler, set via
+// Config.HandlerContext. ctx is derived from the one passed to Listen and is
+// cancelled as soon as Listen starts shutting down, so handlers can abort
+// in-flight work. For events it carries the event's ID and type; see
+// EventIDFromContext.
+type EventHandlerContext interface {
+	OnWebhookEvent(ctx context.Context, evt WebhookEvent, parsed StripeEventPayload)
+	OnV2Event(ctx context.Context, evt V2Event, parsed V2EventPayload)
+	OnUnknownMessage(ctx context.Context, rawType string, data json.RawMessage)
+}
+
+// WebhookACKHandler is optionally implemented by a handler that decides
+// per event whether a v1 webhook event is ACKed. When it is,
+// HandleWebhookEvent is called instead of OnWebhookEvent and the ACK is
+// sent only after it returns nil; on error the event is left un-ACKed.
+//
+// Stripe redelivers un-ACKed events, so a declined event comes back
+// later, possibly on another connection and out of order with newer
+// events for the same object. Redelivery follows Stripe's own retry
+// schedule rather than anything the listener controls, and an event that
+// is declined repeatedly is eventually given up on. A declined event's ID
+// is removed from the DedupWindow cache so its redelivery is handled.
+// Events dropped by filters, and events whose payload fails to parse, are
+// still ACKed straight away.
+type WebhookACKHandler interface {
+	HandleWebhookEvent(ctx context.Context, evt WebhookEvent, parsed StripeEventPayload) error
+}
+
+// UnknownMessageHandler is optionally implemented by a handler that wants
+// unknown messages with their common fields already decoded. When it is,
+// HandleUnknownMessage is called instead of OnUnknownMessage.
+type UnknownMessageHandler interface {
+	HandleUnknownMessage(ctx context.Context, msg UnknownMessage)
+}
+
+// withoutContext adapts an EventHandler to EventHandlerContext.
+type withoutContext struct{ h EventHandler }
+
+func (w withoutContext) OnWebhookEvent(_ context.Context, evt WebhookEvent, parsed StripeEventPayload) {
+	w.h.OnWebhookEvent(evt, parsed)
+}
+
+func (w withoutContext) OnV2Event(_ context.Context, evt V2Event, parsed V2EventPayload) {
+	w.h.OnV2Event(evt, parsed)
+}
+
+func (w withoutContext) OnUnknownMessage(_ context.Context, rawType string, data json.RawMessage) {
+	w.h.OnUnknownMessage(rawType, data)
+}
+
+// HandlerFunc adapts a plain function to EventHandler. The function receives
+// v1 webhook events; v2 events and unknown messages are ignored.
+type HandlerFunc func(evt WebhookEvent, parsed StripeEventPayload)
+
+func (f HandlerFunc) OnWebhookEvent(evt WebhookEvent, parsed StripeEventPayload) { f(evt, parsed) }
+func (HandlerFunc) OnV2Event(V2Event, V2EventPayload)                            {}
+func (HandlerFunc) OnUnknownMessage(string, json.RawMessage)                     {}
+
+// SystemEventHandler is optionally implemented by a handler to receive
+// the listener's own lifecycle transitions when Config.DeliverLifecycleEvents
+// is set. These are synthetic events: they never come from Stripe and are
+// never ACKed.
+type SystemEventHandler interface {
+	OnSystemEvent(kind string, detail map[string]interface{})
+}
+
+// Kinds passed to SystemEventHandler.OnSystemEvent.
+const (
+	SystemEventConnected    = "connected"    // detail: websocket_id, feature
+	SystemEventDisconnected = "disconnected" // detail: error (nil on clean exit)
+	SystemEventReconnecting = "reconnecting" // detail: attempt, wait (time.Duration), error
+	SystemEventStalled      = "stalled"      // detail: idle (time.Duration); sent before Listen fails with ErrIdleTimeout
+)
+
 // ---------------------------------------------------------------------------
 // Config
 // ---------------------------------------------------------------------------
 
 // Config configures the Listener.
 type Config struct {
-	// APIKey is the Stripe secret key (sk_test_... or sk_live_...). Required.
+	// APIKey is the Stripe secret key (sk_test_... or sk_live_...). Required
+	// unless APIKeyFunc is set.
 	APIKey string
 
+	// APIKeyFunc, when set, is called for the current key before every
+	// authorize request, including those made by ListenWithReconnect and
+	// session refreshes, and before FetchRelatedObject. This lets a rotated
+	// key take effect without restarting. An error fails that request; an
+	// empty key falls back to APIKey.
+	APIKeyFunc func(ctx context.Context) (string, error)
+
+	// AccountID identifies the account in handler contexts (see
+	// AccountIDFromContext), to route events when several Listeners share a
+	// handler. Empty uses a fingerprint of the API key: its prefix and last
+	// four characters, e.g. "sk_live_...4242".
+	AccountID string
+
+	// APIBaseURL is the base URL Authorize posts to, e.g. a local mock or
+	// a proxy. Defaults to https://api.stripe.com. The WebSocket URL always
+	// comes from the session response.
+	APIBaseURL string
+
+	// ExtraHeaders are added to the authorize request, FetchRelatedObject
+	// requests and the WebSocket handshake, e.g. for an API gateway. A
+	// header the library sets itself keeps the library's value unless
+	// ExtraHeadersOverride is true.
+	ExtraHeaders http.Header
+
+	// ExtraHeadersOverride lets ExtraHeaders replace headers set by the
+	// library, such as User-Agent.
+	ExtraHeadersOverride bool
+
+	// APIVersion pins the Stripe API version, e.g. "2022-11-15" or
+	// "2024-09-30.acacia", sent as the Stripe-Version header when creating
+	// the session. Empty uses the account's default version. A value that
+	// does not look like a version is a configuration error.
+	APIVersion string
+
 	// DeviceName sent to Stripe during session creation. Optional.
 	DeviceName string
 
-	// WebSocketFeatures to request. Defaults to ["webhooks"].
+	// WebSocketFeatures to request. Defaults to ["webhooks"]. ListenAll and
+	// ListenWithReconnect open a separate connection per feature.
 	WebSocketFeatures []string
 
-	// Handler receives events. Required.
+	// Handler receives events. Required unless HandlerContext or OnWebhook
+	// is set.
 	Handler EventHandler
 
+	// HandlerContext receives events together with a context. Use it
+	// instead of Handler; setting both is a configuration error, returned
+	// by Authorize, Connect and the Listen methods.
+	HandlerContext EventHandlerContext
+
+	// OnWebhook is a shorthand for Handler: HandlerFunc(OnWebhook). Setting
+	// both Handler and OnWebhook is a configuration error, returned by
+	// Authorize, Connect and the Listen methods.
+	OnWebhook func(evt WebhookEvent, parsed StripeEventPayload)
+
 	// Logger for debug output. Nil disables logging.
 	Logger Logger
 
@@ -75,19 +218,414 @@ type Config struct {
 	// PingPeriod is how often to send WebSocket pings.
 	PingPeriod time.Duration
 
+	// PingJitter randomizes each ping interval to PingPeriod plus or minus
+	// up to PingJitter, so that many listeners don't ping in lockstep. It is
+	// capped at half of PingPeriod. Zero pings at exactly PingPeriod.
+	PingJitter time.Duration
+
 	// WriteWait is the deadline for writing a single frame.
 	WriteWait time.Duration
 
+	// RateLimit, when > 0, caps how many events per second reach the
+	// handler, with bursts of up to RateBurst (default 1). Events above the
+	// rate wait their turn; filtered and duplicate events don't count, and
+	// the limit is shared by all connections of a Listener. Waiting stops
+	// as soon as Listen shuts down; events already ACKed by then are still
+	// handled, without waiting, before Listen returns.
+	//
+	// By default events are still ACKed on receipt and only handler calls
+	// are delayed. Without Concurrency the read loop waits for each handler
+	// call, so later events are read (and ACKed) only as fast as the rate;
+	// with Concurrency the read loop keeps ACKing until the QueueSize queue
+	// is full.
+	RateLimit float64
+	RateBurst int
+
+	// RateLimitACK makes an event wait for RateLimit before it is ACKed, in
+	// the read loop, rather than only before its handler call.
+	RateLimitACK bool
+
+	// MaxMessageBytes caps the size of a single incoming message. A larger
+	// message fails the connection with websocket.ErrReadLimit, after which
+	// ListenWithReconnect reconnects. Defaults to DefaultMaxMessageBytes;
+	// negative disables the limit.
+	MaxMessageBytes int64
+
+	// Concurrency, when > 0, runs handlers on that many worker goroutines
+	// so the read loop only ACKs and enqueues. Zero calls handlers inline.
+	Concurrency int
+
+	// PreserveOrderByObject routes events for the same object to the same
+	// worker, keeping their relative order. v1 events are keyed on their
+	// data.object id and v2 events on their related_object id, or on the
+	// event ID when they have none. Only meaningful with Concurrency > 1.
+	PreserveOrderByObject bool
+
+	// QueueSize bounds the handler queue (per worker when
+	// PreserveOrderByObject is set). When it is full the read loop waits,
+	// which applies backpressure to Stripe. Defaults to 64.
+	QueueSize int
+
+	// SessionRefreshInterval, when > 0, makes ListenWithReconnect create a
+	// fresh session this often and move to it before the current one
+	// expires: the new session is authorized first, then the old
+	// connection is closed and its in-flight events drained, then the new
+	// one is dialed, without any backoff. OnDisconnect sees
+	// ErrSessionRefresh for these planned disconnects. If the refresh
+	// request fails, the current connection is kept and the refresh is
+	// tried again after another interval.
+	SessionRefreshInterval time.Duration
+
+	// ReconnectReuseSession makes ListenWithReconnect redial with the
+	// session it already holds instead of authorizing a new one, saving an
+	// API request and a session slot when a connection flaps. Stripe
+	// doesn't say when a session expires; a session counts as expired when
+	// the dial is refused with a 4xx handshake response (HandshakeError),
+	// and then a new session is authorized straight away. Other dial
+	// failures keep the session and back off as usual.
+	ReconnectReuseSession bool
+
+	// WarmSpareSession makes ListenWithReconnect keep a spare session
+	// authorized in the background. When a working connection drops, the
+	// spare is dialed straight away, with neither an Authorize request nor
+	// a backoff wait, and another spare is authorized. This costs one
+	// extra Authorize request per reconnect, plus one at startup, and the
+	// spare holds a second session slot on the account the whole time. A
+	// spare that has expired by the time it is used fails to dial, and the
+	// next attempt authorizes as usual.
+	WarmSpareSession bool
+
+	// MaxEventsPerConnection, when > 0, makes ListenWithReconnect rotate
+	// to a new connection once this many events have been dispatched on
+	// the current one. The rotation is a session refresh: the new session
+	// is authorized first, then the old connection is drained and closed,
+	// then the new one is dialed. Events the old connection delivered but
+	// could not ACK in time are redelivered on the new one, so DedupWindow
+	// defaults to 10 minutes when this is set. Listen and ListenAll ignore
+	// it.
+	MaxEventsPerConnection int
+
+	// MaxReconnectWait caps the backoff between ListenWithReconnect attempts.
+	// Zero or negative uses DefaultMaxReconnectWait.
+	MaxReconnectWait time.Duration
+
 	// HTTPClient used for the authorize request. Nil uses a default.
 	HTTPClient *http.Client
+
+	// AuthorizeRetries is how many times Authorize retries after a network
+	// error or a 5xx response. TLS certificate verification failures are
+	// not retried. Zero disables retries.
+	AuthorizeRetries int
+
+	// AuthorizeRetryWait is the wait before the first retry; it doubles on
+	// each further retry. Defaults to 1s.
+	AuthorizeRetryWait time.Duration
+
+	// ConnectRetries is how many times Connect retries the WebSocket dial
+	// after a network error or a 5xx handshake response, reusing the
+	// current session instead of authorizing again. TLS certificate
+	// verification failures are not retried. The waits follow the
+	// ListenWithReconnect backoff. Zero disables retries.
+	ConnectRetries int
+
+	// TLSClientConfig is used for the WebSocket handshake and, when
+	// HTTPClient is nil, for the authorize request, e.g. to trust a
+	// corporate proxy's CA through RootCAs.
+	//
+	// Never set InsecureSkipVerify outside local testing: it disables
+	// certificate checks, so anyone on the network path can impersonate
+	// Stripe, read the API key sent to Authorize and the session's
+	// Websocket-Id, and feed the handler forged events.
+	TLSClientConfig *tls.Config
+
+	// ClientCertificates are presented to servers that request a client
+	// certificate, for proxies and gateways that enforce mutual TLS. They
+	// are added to TLSClientConfig (or to Dialer's, when it has one) for
+	// the WebSocket handshake and, when HTTPClient is nil, the authorize
+	// request.
+	ClientCertificates []tls.Certificate
+
+	// Proxy selects the proxy for the authorize request (when HTTPClient is
+	// nil) and the WebSocket dial (when Dialer is nil), in place of
+	// http.ProxyFromEnvironment. Both honour http, https and socks5 proxy
+	// URLs, e.g. http.ProxyURL(&url.URL{Scheme: "socks5", Host: "proxy:1080"}).
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// EnableCompression offers permessage-deflate during the WebSocket
+	// handshake and drops the Accept-Encoding: identity header. Frames are
+	// only compressed if the server accepts. Off by default.
+	//
+	// Event JSON is repetitive and typically deflates to a fraction of its
+	// size, so this saves bandwidth on busy accounts, at the price of
+	// inflating every frame on the read loop and deflating every ACK.
+	// gorilla's implementation does not keep a compression context between
+	// messages, which limits the gain on small frames such as ACKs. Stats
+	// byte counts are measured uncompressed either way; compare network
+	// counters to judge the effect.
+	EnableCompression bool
+
+	// HandshakeTimeout bounds the WebSocket dial, TLS and HTTP upgrade in
+	// Connect. Defaults to DefaultHandshakeTimeout. A deadline on the ctx
+	// passed to Connect also applies; whichever is sooner wins. It is also
+	// applied to Dialer when that leaves its own HandshakeTimeout zero.
+	HandshakeTimeout time.Duration
+
+	// Dialer, if set, is used by Connect instead of the default dialer,
+	// e.g. to reach a local httptest server. It is copied before use. Empty
+	// Subprotocols default to the Stripe CLI subprotocol, and a nil
+	// TLSClientConfig defaults to the one above.
+	Dialer *ws.Dialer
+
+	// ForwardTo, if set, is a URL every dispatched v1 webhook event is POSTed
+	// to, with the original EventPayload as body and the event's HTTPHeaders
+	// replayed, like `stripe listen --forward-to`. Forwarding runs in the
+	// background; failures and non-2xx responses are logged and never stop
+	// the listener. Each response is reported back to Stripe as a
+	// webhook_response message, as the Stripe CLI does, on the connection
+	// the event arrived on. Requests still running when Listen returns are
+	// cancelled, and a response that arrives after the connection has
+	// changed is dropped.
+	ForwardTo string
+
+	// ForwardHTTPClient is used for ForwardTo requests. Nil uses a client
+	// with a 30s timeout.
+	ForwardHTTPClient *http.Client
+
+	// SigningSecret signs forwarded requests with a Stripe-Signature header
+	// so webhook.ConstructEvent accepts them. Defaults to the session's
+	// secret; set it to the whsec_... secret your endpoint verifies with if
+	// that differs.
+	SigningSecret string
+
+	// OnOutgoingFrame, if set, is called with every frame the listener is
+	// about to write (ACKs, pings, close). It runs synchronously inside the
+	// serialized write path, so it must return quickly and must not write
+	// to the connection itself, e.g. through ACK or Close. Other Listener
+	// methods, such as Session or Stop, are safe to call from it.
+	OnOutgoingFrame func(messageType int, data []byte)
+
+	// Sink, if set, receives every v1 and v2 event as one compact JSON
+	// object per line with its id, type, kind, received_at and the raw
+	// payload, before any filtering. Writes are serialized; a writer with a
+	// Flush() error method, such as *bufio.Writer, is flushed after each
+	// line. It complements the handler rather than replacing it.
+	Sink io.Writer
+
+	// BatchSize, when > 0 and the handler implements BatchHandler, groups
+	// v1 webhook events into batches of up to this many events.
+	BatchSize int
+
+	// BatchMaxWait is how long the first event of a batch may wait for the
+	// batch to fill up before it is flushed anyway. Defaults to 1s.
+	BatchMaxWait time.Duration
+
+	// BatchACKAfterFlush delays each batched event's ACK until OnBatch has
+	// returned nil for its batch. By default events are ACKed on receipt.
+	// ACKs of the batch flushed at shutdown usually fail because the
+	// connection is already closing; Stripe then redelivers those events.
+	BatchACKAfterFlush bool
+
+	// DisableAutoACK stops the listener from ACKing events itself, e.g. to
+	// measure raw throughput. Events are then only ACKed through ACK and
+	// ACKV2, and Stripe redelivers the rest.
+	DisableAutoACK bool
+
+	// OnACK, if set, is called after every ACK write with the event ID and
+	// the write error (nil on success). It runs inline on the goroutine that
+	// sent the ACK, usually the read loop, so it must return quickly.
+	OnACK func(eventID string, err error)
+
+	// OnMalformed, if set, is called with the raw frame and the decode error
+	// whenever a frame is not valid JSON, e.g. to count failures or capture
+	// protocol drift. The frame is dropped afterwards, as before. It runs on
+	// the read loop, so it must return quickly.
+	OnMalformed func(raw []byte, err error)
+
+	// Errors, if set, receives non-fatal problems as they happen: an
+	// *ACKError when an ACK could not be written, a *MalformedMessageError
+	// when a frame or payload could not be decoded and a *SinkError when
+	// writing to Sink failed.
+	// Sends never block; when the channel is full the error is logged and
+	// dropped.
+	Errors chan<- error
+
+	// DedupWindow, when > 0, drops v1 and v2 events whose ID was already
+	// seen within the window (measured from the first delivery), including
+	// across reconnects. Duplicates are still ACKed. Off by default.
+	DedupWindow time.Duration
+
+	// DedupSize bounds how many event IDs are remembered for DedupWindow;
+	// the least recently seen are evicted first. Defaults to 10000.
+	DedupSize int
+
+	// EventTypes, when non-empty, restricts which v1 and v2 events reach the
+	// handler. Entries are exact types or wildcard patterns such as
+	// "payment_intent.*". Events that don't match are still ACKed.
+	EventTypes []string
+
+	// HandlerTimeout, when > 0, gives the ctx passed to v1 and v2 event
+	// handlers, WebhookACKHandler included, a deadline that long after the
+	// handler is called. Handlers must watch ctx to honor it; Listen does
+	// not abandon a handler that overruns. Off by default.
+	HandlerTimeout time.Duration
+
+	// HandlerTimeouts overrides HandlerTimeout per event type. Keys are
+	// exact types or patterns as in EventTypes. An exact key wins over any
+	// pattern, the longest matching pattern wins over shorter ones, and
+	// HandlerTimeout applies when nothing matches. A value <= 0 removes the
+	// deadline for the types it matches.
+	HandlerTimeouts map[string]time.Duration
+
+	// Accounts, when non-empty, restricts v1 webhook events to those whose
+	// `account` is in the list. Events for the platform account itself carry
+	// an empty account and only pass if "" is listed.
+	Accounts []string
+
+	// AccountFilter, if set, is called with each v1 event's `account` and
+	// must return true for the event to be dispatched. It is applied after
+	// Accounts; both must pass. Filtered-out events are still ACKed.
+	AccountFilter func(account string) bool
+
+	// DestinationIDs, when non-empty, restricts v2 events to those whose
+	// EventDestinationID is in the list. It is applied together with
+	// EventTypes: a v2 event must pass both to be dispatched. Filtered-out
+	// events are still ACKed.
+	DestinationIDs []string
+
+	// LiveModeOnly, when set, dispatches only live-mode events (true) or
+	// only test-mode events (false), based on the payload's livemode. Nil
+	// dispatches both. Filtered-out events are still ACKed.
+	LiveModeOnly *bool
+
+	// WebSocketHostOverride, if set, replaces the Host header and the TLS
+	// server name (SNI) used for the WebSocket handshake, while the dial
+	// still targets the address from the session's websocket_url. It does
+	// not affect Authorize.
+	//
+	// The server certificate is verified against this name instead of the
+	// session host, so only point it at infrastructure you control (for
+	// example a TLS-terminating proxy in a split-horizon network); a wrong
+	// value can hand the session's Websocket-Id to an unintended endpoint.
+	WebSocketHostOverride string
+
+	// BufferSize, when > 0, keeps the last BufferSize v1 webhook events in
+	// memory for RecentEvents. It does not affect ACKs or dispatch.
+	BufferSize int
+
+	// Metrics, if set, receives event, handler, reconnect and ACK failure
+	// measurements. Nil disables metrics.
+	Metrics Metrics
+
+	// AuditSink, if set, is told about every received, ACKed and skipped
+	// event. Nil disables auditing.
+	AuditSink AuditSink
+
+	// DeliverLifecycleEvents routes connection lifecycle transitions to the
+	// handler's OnSystemEvent, if it implements SystemEventHandler.
+	DeliverLifecycleEvents bool
+
+	// ACKAfter, when > 0, bounds how long an ACK waits for a handler that
+	// decides it, i.e. a WebhookACKHandler or a batch with
+	// BatchACKAfterFlush: the event is ACKed that long after receipt even if
+	// the handler is still running. A handler that then fails can no longer
+	// get the event redelivered, so this trades Stripe's at-least-once
+	// delivery for freedom from redeliveries of slow events; the failure is
+	// only logged. Events ACKed on receipt are unaffected.
+	ACKAfter time.Duration
+
+	// OrderedACKs sends a connection's v1 ACKs in the order the events were
+	// received, even when a WebhookACKHandler or BatchACKAfterFlush lets
+	// handlers finish out of order: an event's ACK waits until every
+	// earlier event has been ACKed or declined. Events ACKed on receipt
+	// wait their turn too, in the read loop. The wait is bounded by
+	// OrderedACKWait, after which the ACK is sent anyway and a warning
+	// logged, so a stuck handler can't hold the connection forever.
+	//
+	// Strict order costs throughput: a slow handler holds up the ACKs, and
+	// with it the workers, of everything received after it, and ACKs on
+	// receipt stall the read loop. Leave it off unless a sink downstream
+	// depends on ACK order.
+	OrderedACKs bool
+
+	// OrderedACKWait bounds how long OrderedACKs holds an ACK for earlier
+	// ones. Defaults to DefaultOrderedACKWait.
+	OrderedACKWait time.Duration
+
+	// MaxEvents, when > 0, stops the listener once that many v1 and v2
+	// events have been dispatched to the handler, counted over the
+	// Listener's lifetime: the connection is closed cleanly and Listen,
+	// ListenAll and ListenWithReconnect return nil after in-flight handlers
+	// finish and send their deferred ACKs. Filtered and duplicate events don't count. Events arriving
+	// afterwards on another feature's connection are left un-ACKed, though
+	// one may still slip through on each while the first stops. ReplayFile
+	// stops at the limit too.
+	MaxEvents int
+
+	// ReplayRealtime makes ReplayFile reproduce the original spacing
+	// between recorded events instead of replaying them back to back.
+	ReplayRealtime bool
+
+	// OnConnect, if set, is called after Connect succeeds.
+	OnConnect func(session *Session)
+
+	// OnDisconnect, if set, is called when Listen's read loop has exited,
+	// with the error Listen is about to return. It runs before
+	// ListenWithReconnect decides whether to reconnect.
+	OnDisconnect func(err error)
+
+	// Clock supplies the time for pings, deadlines, backoff and event
+	// timestamps. Nil uses the system clock; tests can inject a fake.
+	Clock Clock
+
+	// MaxIdle, when > 0, closes the connection if neither a message nor a
+	// pong has been received for this long, independently of the read
+	// deadline, so ListenWithReconnect can replace a silently stalled
+	// connection. Listen then returns an error wrapping ErrIdleTimeout.
+	// Keep it well above PingPeriod, since pongs count as activity.
+	MaxIdle time.Duration
+
+	// RequireSubprotocol makes Connect fail if the server does not agree to
+	// one of the subprotocols offered: Subprotocol, or Dialer.Subprotocols
+	// when set. Nil means true; use Bool(false) to accept a connection
+	// without one.
+	RequireSubprotocol *bool
+
+	// Subprotocol is the WebSocket subprotocol to request. Defaults to the
+	// Subprotocol constant.
+	Subprotocol string
+
+	// CLIVersion is the Stripe CLI version announced in the User-Agent and
+	// X-Stripe-Client-User-Agent headers. Defaults to the version this
+	// package was last checked against.
+	CLIVersion string
 }
 
-func (c *Config) defaults() {
+// Bool returns a pointer to v, for optional Config fields.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// apiVersionRE loosely matches Stripe API versions: a release date with an
+// optional release name, as in "2024-09-30.acacia".
+var apiVersionRE = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(\.[a-z]+)?$`)
+
+// defaults fills in unset fields and returns the configuration error, if
+// any. The defaults are applied even then, so that the methods which don't
+// report the error still find a usable Config.
+func (c *Config) defaults() error {
+	err := c.validate()
+	if c.OnWebhook != nil && c.Handler == nil {
+		c.Handler = HandlerFunc(c.OnWebhook)
+	}
+	if c.APIBaseURL == "" {
+		c.APIBaseURL = apiBase
+	}
+	c.APIBaseURL = strings.TrimSuffix(c.APIBaseURL, "/")
 	if c.DeviceName == "" {
 		c.DeviceName = "custom-stripe-listener"
 	}
 	if len(c.WebSocketFeatures) == 0 {
-		c.WebSocketFeatures = []string{"webhooks"}
+		c.WebSocketFeatures = []string{FeatureWebhooks}
 	}
 	if c.PongWait == 0 {
 		c.PongWait = DefaultPongWait
@@ -95,15 +633,118 @@ func (c *Config) defaults() {
 	if c.PingPeriod == 0 {
 		c.PingPeriod = DefaultPingPeriod
 	}
+	if c.PingJitter < 0 {
+		c.PingJitter = 0
+	} else if c.PingJitter > c.PingPeriod/2 {
+		c.PingJitter = c.PingPeriod / 2
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
 	if c.WriteWait == 0 {
 		c.WriteWait = DefaultWriteWait
 	}
+	if c.MaxMessageBytes == 0 {
+		c.MaxMessageBytes = DefaultMaxMessageBytes
+	} else if c.MaxMessageBytes < 0 {
+		c.MaxMessageBytes = 0
+	}
+	if c.RateBurst <= 0 {
+		c.RateBurst = 1
+	}
+	if c.DedupSize <= 0 {
+		c.DedupSize = 10000
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 64
+	}
+	if c.BatchMaxWait <= 0 {
+		c.BatchMaxWait = time.Second
+	}
+	if c.AuthorizeRetryWait <= 0 {
+		c.AuthorizeRetryWait = time.Second
+	}
+	if c.MaxEventsPerConnection > 0 && c.DedupWindow == 0 {
+		c.DedupWindow = 10 * time.Minute
+	}
+	if c.OrderedACKWait <= 0 {
+		c.OrderedACKWait = DefaultOrderedACKWait
+	}
+	if c.MaxReconnectWait <= 0 {
+		c.MaxReconnectWait = DefaultMaxReconnectWait
+	}
+	if c.Subprotocol == "" {
+		c.Subprotocol = Subprotocol
+	}
+	if c.CLIVersion == "" {
+		c.CLIVersion = cliVersion
+	}
+	if c.RequireSubprotocol == nil {
+		c.RequireSubprotocol = Bool(true)
+	}
 	if c.HTTPClient == nil {
 		c.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+		if c.TLSClientConfig != nil || len(c.ClientCertificates) > 0 || c.Proxy != nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = c.tlsConfig(c.TLSClientConfig)
+			if c.Proxy != nil {
+				t.Proxy = c.Proxy
+			}
+			c.HTTPClient.Transport = t
+		}
+	}
+	if c.ForwardHTTPClient == nil {
+		c.ForwardHTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if c.Clock == nil {
+		c.Clock = realClock{}
+	}
+	if c.Metrics == nil {
+		c.Metrics = nopMetrics{}
+	}
+	if c.AuditSink == nil {
+		c.AuditSink = nopAuditSink{}
 	}
 	if c.Logger == nil {
 		c.Logger = nopLogger{}
+	} else if _, ok := c.Logger.(safeLogger); !ok {
+		c.Logger = safeLogger{l: c.Logger, once: new(sync.Once)}
+	}
+	switch {
+	case c.APIKey == "":
+	case strings.HasPrefix(c.APIKey, "pk_"):
+		c.Logger.Warnf("config: APIKey is a publishable key (pk_...); a secret key (sk_...) or restricted key (rk_...) is required")
+	case !strings.HasPrefix(c.APIKey, "sk_") && !strings.HasPrefix(c.APIKey, "rk_"):
+		c.Logger.Warnf("config: APIKey does not look like a Stripe secret key (sk_...) or restricted key (rk_...)")
+	}
+	return err
+}
+
+// validate reports settings that contradict each other or are malformed.
+func (c *Config) validate() error {
+	if c.OnWebhook != nil && c.Handler != nil {
+		return errors.New("config: set either Handler or OnWebhook, not both")
+	}
+	if (c.Handler != nil || c.OnWebhook != nil) && c.HandlerContext != nil {
+		return errors.New("config: set either Handler or HandlerContext, not both")
+	}
+	if c.APIVersion != "" && !apiVersionRE.MatchString(c.APIVersion) {
+		return fmt.Errorf("config: APIVersion %q is not of the form YYYY-MM-DD[.name]", c.APIVersion)
 	}
+	return nil
+}
+
+// tlsConfig returns a copy of base with ClientCertificates added, or nil
+// if both are unset.
+func (c *Config) tlsConfig(base *tls.Config) *tls.Config {
+	t := base.Clone()
+	if len(c.ClientCertificates) > 0 {
+		if t == nil {
+			t = &tls.Config{}
+		}
+		t.Certificates = append(t.Certificates, c.ClientCertificates...)
+	}
+	return t
 }
 
 // Logger is a minimal logging interface.
@@ -121,6 +762,92 @@ func (nopLogger) Infof(string, ...interface{})  {}
 func (nopLogger) Warnf(string, ...interface{})  {}
 func (nopLogger) Errorf(string, ...interface{}) {}
 
+// safeLogger shields the read and write paths from a Logger that panics.
+// A panicking call drops that log line; the first panic is reported on
+// stderr so the loss isn't silent.
+type safeLogger struct {
+	l    Logger
+	once *sync.Once
+}
+
+func (s safeLogger) Debugf(f string, a ...interface{}) { defer s.recover(); s.l.Debugf(f, a...) }
+func (s safeLogger) Infof(f string, a ...interface{})  { defer s.recover(); s.l.Infof(f, a...) }
+func (s safeLogger) Warnf(f string, a ...interface{})  { defer s.recover(); s.l.Warnf(f, a...) }
+func (s safeLogger) Errorf(f string, a ...interface{}) { defer s.recover(); s.l.Errorf(f, a...) }
+
+// StructuredLogger is optionally implemented by a Logger. When it is, key
+// events (session created, connected, event received, reconnecting) are
+// logged through it with their details as fields instead of being
+// formatted into the message.
+type StructuredLogger interface {
+	Debug(msg string, fields map[string]interface{})
+	Info(msg string, fields map[string]interface{})
+	Warn(msg string, fields map[string]interface{})
+	Error(msg string, fields map[string]interface{})
+}
+
+// Levels accepted by Listener.logw.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logw logs a key event with fields, through StructuredLogger when the
+// configured Logger implements it and as "msg key=value ..." otherwise.
+func (l *Listener) logw(level int, msg string, fields map[string]interface{}) {
+	if _, ok := l.cfg.Logger.(nopLogger); ok {
+		return
+	}
+	if s, ok := l.cfg.Logger.(safeLogger); ok {
+		if sl, ok := s.l.(StructuredLogger); ok {
+			defer s.recover()
+			switch level {
+			case levelDebug:
+				sl.Debug(msg, fields)
+			case levelInfo:
+				sl.Info(msg, fields)
+			case levelWarn:
+				sl.Warn(msg, fields)
+			default:
+				sl.Error(msg, fields)
+			}
+			return
+		}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	line := b.String()
+	switch level {
+	case levelDebug:
+		l.cfg.Logger.Debugf("%s", line)
+	case levelInfo:
+		l.cfg.Logger.Infof("%s", line)
+	case levelWarn:
+		l.cfg.Logger.Warnf("%s", line)
+	default:
+		l.cfg.Logger.Errorf("%s", line)
+	}
+}
+
+func (s safeLogger) recover() {
+	if r := recover(); r != nil {
+		s.once.Do(func() {
+			fmt.Fprintf(os.Stderr, "stripelistener: logger panicked, dropping log lines: %v\n", r)
+		})
+	}
+}
+
 // ---------------------------------------------------------------------------
 // Listener
 // ---------------------------------------------------------------------------
@@ -129,29 +856,238 @@ func (nopLogger) Errorf(string, ...interface{}) {}
 type Listener struct {
 	cfg  Config
 	conn *ws.Conn
-	mu   sync.Mutex // guards conn writes
+	mu   sync.Mutex // guards conn and the fields below
+	wmu  sync.Mutex // serializes writes to conn; taken before mu
+	rmu  sync.Mutex // orders read deadline changes with stopReading
+
+	session      *Session
+	accounts     map[string]struct{}
+	destinations map[string]struct{}
+	stats        *statCounters
+	trace        *tracer
+	stop         *stopSignal // set while Listen runs
+	cfgErr       error       // from Config.defaults; fails Authorize, Connect and Listen
+	handler      EventHandlerContext
+	workers      *workerPool    // set while Listen runs with Concurrency > 0
+	batchIn      chan batchItem // set while Listen runs with a BatchHandler
+	dedup        *dedupCache
+	recent       *eventRing
+	sink         *eventSink
+	paused       *atomic.Bool
+
+	children []*Listener // one per feature while ListenAll runs with several
+
+	lastPong     atomic.Int64 // unix nanoseconds, 0 before the first pong
+	lastActivity atomic.Int64 // unix nanoseconds of the last message or pong
+
+	ready     chan struct{} // closed after the first successful Connect
+	readyOnce sync.Once
+
+	done     chan struct{} // closed when a Listen call returns; see Done
+	doneOnce sync.Once
+	doneErr  error
+
+	apiKey *atomic.Value // string; the key last sent, shared with children
+
+	limiter *rate.Limiter // nil without Config.RateLimit
+
+	eventCount *atomic.Int64 // events dispatched, for Config.MaxEvents
+
+	inflight inflightSet // conversations received but not yet ACKed
+
+	ackTail chan struct{} // closed once the last deferred ACK is settled; for OrderedACKs
 
-	session *Session
+	connEvents atomic.Int64  // events dispatched on the current connection
+	rotate     chan struct{} // requests a session refresh; set while ListenWithReconnect is connected
+	looping    bool          // set while ListenWithReconnect runs
 }
 
 // New creates a Listener. Call Listen() to start.
 func New(cfg Config) *Listener {
-	cfg.defaults()
-	return &Listener{cfg: cfg}
+	cfgErr := cfg.defaults()
+	l := &Listener{
+		cfg:        cfg,
+		cfgErr:     cfgErr,
+		handler:    cfg.HandlerContext,
+		stats:      new(statCounters),
+		trace:      new(tracer),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		paused:     new(atomic.Bool),
+		apiKey:     new(atomic.Value),
+		limiter:    newLimiter(cfg),
+		eventCount: new(atomic.Int64),
+	}
+	l.apiKey.Store(cfg.APIKey)
+	if cfg.Handler != nil {
+		l.handler = withoutContext{cfg.Handler}
+	}
+	if cfg.BufferSize > 0 {
+		l.recent = newEventRing(cfg.BufferSize)
+	}
+	if cfg.Sink != nil {
+		l.sink = &eventSink{w: cfg.Sink}
+	}
+	if cfg.DedupWindow > 0 {
+		l.dedup = newDedupCache(cfg.DedupWindow, cfg.DedupSize)
+	}
+	if len(cfg.Accounts) > 0 {
+		l.accounts = make(map[string]struct{}, len(cfg.Accounts))
+		for _, a := range cfg.Accounts {
+			l.accounts[a] = struct{}{}
+		}
+	}
+	if len(cfg.DestinationIDs) > 0 {
+		l.destinations = make(map[string]struct{}, len(cfg.DestinationIDs))
+		for _, d := range cfg.DestinationIDs {
+			l.destinations[d] = struct{}{}
+		}
+	}
+	return l
+}
+
+// AccountID returns Config.AccountID or, if that is empty, the
+// fingerprint of the API key most recently used.
+func (l *Listener) AccountID() string {
+	if l.cfg.AccountID != "" {
+		return l.cfg.AccountID
+	}
+	k, _ := l.apiKey.Load().(string)
+	return keyFingerprint(k)
+}
+
+// keyFingerprint shortens an API key to a form that is safe to log: the
+// prefix up to the mode and the last four characters. It is empty for keys
+// too short to hide enough of.
+func keyFingerprint(key string) string {
+	if len(key) < 4 {
+		return ""
+	}
+	prefix := ""
+	if i := strings.LastIndexByte(key[:len(key)-4], '_'); i >= 0 {
+		prefix = key[:i+1]
+	}
+	if len(key)-len(prefix)-4 < 8 {
+		return ""
+	}
+	return prefix + "..." + key[len(key)-4:]
+}
+
+// LiveMode reports whether APIKey is a live-mode key (sk_live_... or
+// rk_live_...). Test-mode and unrecognized keys report false. With
+// APIKeyFunc, it reflects the key most recently returned by it.
+func (l *Listener) LiveMode() bool {
+	k, _ := l.apiKey.Load().(string)
+	return strings.HasPrefix(k, "sk_live_") || strings.HasPrefix(k, "rk_live_")
 }
 
 // Session returns the session obtained during Authorize. Nil before Authorize.
+// When ListenAll runs one connection per feature, it returns the session of
+// the first feature; see Sessions.
 func (l *Listener) Session() *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.children) > 0 {
+		return l.children[0].Session()
+	}
 	return l.session
 }
 
+// SetSession installs a session obtained elsewhere, e.g. by another
+// process's Authorize, so Connect can be called without authorizing. The
+// session must have a WebSocketURL and a WebSocketID. It replaces any
+// session from an earlier Authorize and takes effect on the next Connect.
+func (l *Listener) SetSession(s *Session) error {
+	if s == nil || s.WebSocketURL == "" || s.WebSocketID == "" {
+		return errors.New("session needs a websocket_url and websocket_id")
+	}
+	l.mu.Lock()
+	l.session = s
+	l.mu.Unlock()
+	return nil
+}
+
 // ---------------------------------------------------------------------------
 // Authorize – POST /v1/stripecli/sessions
 // Source: https://github.com/stripe/stripe-cli/blob/master/pkg/stripeauth/client.go#L64-L129
 // ---------------------------------------------------------------------------
 
 // Authorize creates a CLI session with Stripe and returns the session data.
+//
+// Every call creates a new session. Processes that listen with the same
+// API key each hold their own session, and Stripe decides how events are
+// spread across them, so one process may not see every event. Stripe
+// exposes no way to list an account's other CLI sessions, so this cannot
+// be detected from here: run a single listener per account when every
+// event must reach the same handler.
+//
+// With AuthorizeRetries set, network errors and 5xx responses are retried
+// after AuthorizeRetryWait, doubling on each attempt. 4xx responses and
+// TLS certificate verification failures are returned straight away.
 func (l *Listener) Authorize(ctx context.Context) (*Session, error) {
+	if l.cfgErr != nil {
+		return nil, l.cfgErr
+	}
+	s, err := l.requestSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.session = s
+	l.mu.Unlock()
+	return s, nil
+}
+
+// requestSession creates a session, with retries, without installing it.
+func (l *Listener) requestSession(ctx context.Context) (*Session, error) {
+	wait := l.cfg.AuthorizeRetryWait
+	for attempt := 0; ; attempt++ {
+		s, err := l.authorize(ctx)
+		if err == nil || attempt >= l.cfg.AuthorizeRetries || !retryableAuthorize(ctx, err) {
+			return s, err
+		}
+		l.cfg.Logger.Warnf("authorize failed, retrying in %s (%d/%d): %v", wait, attempt+1, l.cfg.AuthorizeRetries, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-l.cfg.Clock.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// retryableAuthorize reports whether a failed authorize may succeed when
+// tried again: network errors and 5xx responses.
+func retryableAuthorize(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || certificateError(err) {
+		return false
+	}
+	var ae *AuthorizeError
+	if errors.As(err, &ae) {
+		return ae.StatusCode >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// certificateError reports whether err is a TLS failure that retrying
+// cannot fix: an untrusted, invalid or mismatched certificate, or a server
+// that doesn't speak TLS at all. *url.Error wraps these and is a net.Error,
+// so they must be ruled out before retrying network errors.
+func certificateError(err error) bool {
+	var (
+		verify   *tls.CertificateVerificationError
+		unknown  x509.UnknownAuthorityError
+		invalid  x509.CertificateInvalidError
+		hostname x509.HostnameError
+		notTLS   tls.RecordHeaderError
+	)
+	return errors.As(err, &verify) || errors.As(err, &unknown) || errors.As(err, &invalid) ||
+		errors.As(err, &hostname) || errors.As(err, &notTLS)
+}
+
+// authorize performs a single session request.
+func (l *Listener) authorize(ctx context.Context) (*Session, error) {
 	form := url.Values{}
 	form.Add("device_name", l.cfg.DeviceName)
 	for _, f := range l.cfg.WebSocketFeatures {
@@ -159,13 +1095,21 @@ func (l *Listener) Authorize(ctx context.Context) (*Session, error) {
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST",
-		apiBase+sessionPath,
+		l.cfg.APIBaseURL+sessionPath,
 		strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
 
-	setHeaders(req.Header, l.cfg.APIKey)
+	key, err := l.currentAPIKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req.Header, key, l.cfg.CLIVersion)
+	if l.cfg.APIVersion != "" {
+		req.Header.Set("Stripe-Version", l.cfg.APIVersion)
+	}
+	l.addExtraHeaders(req.Header)
 
 	resp, err := l.cfg.HTTPClient.Do(req)
 	if err != nil {
@@ -178,61 +1122,236 @@ func (l *Listener) Authorize(ctx context.Context) (*Session, error) {
 		return nil, fmt.Errorf("read authorize response: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("authorize failed (HTTP %d): %s", resp.StatusCode, string(body))
+		return nil, &AuthorizeError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RequestID:  resp.Header.Get("Request-Id"),
+		}
 	}
 
 	var s Session
 	if err := json.Unmarshal(body, &s); err != nil {
 		return nil, fmt.Errorf("decode session: %w", err)
 	}
-
-	l.session = &s
-	l.cfg.Logger.Infof("session created ws_id=%s feature=%s", s.WebSocketID, s.WebSocketAuthorizedFeature)
+	s.RequestID = resp.Header.Get("Request-Id")
+	l.logw(levelInfo, "session created", map[string]interface{}{
+		"ws_id":      s.WebSocketID,
+		"feature":    s.WebSocketAuthorizedFeature,
+		"request_id": s.RequestID,
+	})
 	return &s, nil
 }
 
+// currentAPIKey returns the key to send: APIKeyFunc's result if it is set
+// and non-empty, APIKey otherwise. The key is remembered for LiveMode.
+func (l *Listener) currentAPIKey(ctx context.Context) (string, error) {
+	if l.cfg.APIKeyFunc == nil {
+		return l.cfg.APIKey, nil
+	}
+	key, err := l.cfg.APIKeyFunc(ctx)
+	if err != nil {
+		return "", fmt.Errorf("api key: %w", err)
+	}
+	if key == "" {
+		key = l.cfg.APIKey
+	}
+	l.apiKey.Store(key)
+	return key, nil
+}
+
+// AuthorizeError is returned by Authorize for a non-200 response. Use
+// errors.As to tell e.g. an invalid key (401) from rate limiting (429).
+type AuthorizeError struct {
+	StatusCode int
+	Body       string
+
+	// RequestID is the Request-Id response header, useful when contacting
+	// Stripe support.
+	RequestID string
+}
+
+func (e *AuthorizeError) Error() string {
+	return fmt.Sprintf("authorize failed (HTTP %d): %s", e.StatusCode, e.Body)
+}
+
 // ---------------------------------------------------------------------------
 // Connect – WebSocket dial
 // Source: https://github.com/stripe/stripe-cli/blob/master/pkg/websocket/client.go#L285-L334
 // ---------------------------------------------------------------------------
 
-// Connect dials the WebSocket. Call Authorize first.
+// ErrAlreadyConnected is returned by Connect when the Listener already
+// holds an open connection.
+var ErrAlreadyConnected = errors.New("already connected")
+
+// HandshakeError is wrapped by the error Connect returns when the server
+// answered the WebSocket handshake with an HTTP response instead of
+// upgrading, e.g. 401 for a session it no longer accepts.
+type HandshakeError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%v (HTTP %d)", e.Err, e.StatusCode)
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// Connect dials the WebSocket. Call Authorize or SetSession first.
+//
+// A Listener holds at most one connection. If one is already open, Connect
+// returns ErrAlreadyConnected and leaves it untouched; the connection is
+// released when Listen returns, after which Connect may be called again.
 func (l *Listener) Connect(ctx context.Context) error {
-	if l.session == nil {
+	if l.cfgErr != nil {
+		return l.cfgErr
+	}
+	l.mu.Lock()
+	sess := l.session
+	l.mu.Unlock()
+	if sess == nil {
 		return fmt.Errorf("call Authorize before Connect")
 	}
+	if l.connected() {
+		return ErrAlreadyConnected
+	}
 
 	header := http.Header{}
-	setHeaders(header, "")
-	header.Set("Websocket-Id", l.session.WebSocketID)
+	setHeaders(header, "", l.cfg.CLIVersion)
+	header.Set("Websocket-Id", sess.WebSocketID)
+	l.addExtraHeaders(header)
 
-	wsURL := l.session.WebSocketURL + "?websocket_feature=" + l.session.WebSocketAuthorizedFeature
+	wsURL := sess.WebSocketURL + "?websocket_feature=" + sess.WebSocketAuthorizedFeature
 
-	dialer := ws.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-		Proxy:            http.ProxyFromEnvironment,
-		Subprotocols:     []string{subprotocol},
+	dialer := ws.Dialer{Proxy: http.ProxyFromEnvironment}
+	if l.cfg.Proxy != nil {
+		dialer.Proxy = l.cfg.Proxy
+	}
+	if l.cfg.Dialer != nil {
+		dialer = *l.cfg.Dialer
+	}
+	if dialer.HandshakeTimeout == 0 {
+		dialer.HandshakeTimeout = l.cfg.HandshakeTimeout
+	}
+	if l.cfg.EnableCompression {
+		dialer.EnableCompression = true
+		header.Del("Accept-Encoding")
+	}
+	if len(dialer.Subprotocols) == 0 {
+		dialer.Subprotocols = []string{l.cfg.Subprotocol}
+	}
+	if dialer.TLSClientConfig == nil {
+		dialer.TLSClientConfig = l.cfg.TLSClientConfig
+	}
+	// Clone so the changes below never mutate a caller's config.
+	dialer.TLSClientConfig = l.cfg.tlsConfig(dialer.TLSClientConfig)
+	if h := l.cfg.WebSocketHostOverride; h != "" {
+		header.Set("Host", h)
+		serverName := h
+		if host, _, err := net.SplitHostPort(h); err == nil {
+			serverName = host
+		}
+		if dialer.TLSClientConfig == nil {
+			dialer.TLSClientConfig = &tls.Config{}
+		}
+		dialer.TLSClientConfig.ServerName = serverName
 	}
 
 	l.cfg.Logger.Debugf("dialing %s", wsURL)
-	conn, resp, err := dialer.DialContext(ctx, wsURL, header)
+	conn, err := l.dial(ctx, &dialer, wsURL, header)
 	if err != nil {
-		extra := ""
-		if resp != nil && resp.Body != nil {
-			b, _ := io.ReadAll(resp.Body)
-			extra = " | " + string(b)
-		}
-		return fmt.Errorf("websocket dial: %w%s", err, extra)
+		return err
 	}
-	if resp != nil && resp.Body != nil {
-		resp.Body.Close()
+	if *l.cfg.RequireSubprotocol && !offered(dialer.Subprotocols, conn.Subprotocol()) {
+		conn.Close()
+		return fmt.Errorf("websocket dial: server did not negotiate subprotocol %q (got %q)", dialer.Subprotocols, conn.Subprotocol())
 	}
 
+	l.mu.Lock()
+	if l.conn != nil {
+		// Lost a race with a concurrent Connect.
+		l.mu.Unlock()
+		conn.Close()
+		return ErrAlreadyConnected
+	}
 	l.conn = conn
-	l.cfg.Logger.Infof("websocket connected")
+	l.mu.Unlock()
+	// A pong from the previous connection says nothing about this one.
+	l.lastPong.Store(0)
+	l.stats.connectedSince.Store(l.cfg.Clock.Now().UnixNano())
+
+	l.logw(levelInfo, "websocket connected", map[string]interface{}{
+		"ws_id":   sess.WebSocketID,
+		"feature": sess.WebSocketAuthorizedFeature,
+	})
+	l.markReady()
+	if l.cfg.OnConnect != nil {
+		l.cfg.OnConnect(sess)
+	}
+	l.systemEvent(SystemEventConnected, map[string]interface{}{
+		"websocket_id": sess.WebSocketID,
+		"feature":      sess.WebSocketAuthorizedFeature,
+	})
 	return nil
 }
 
+// dial dials wsURL, retrying network errors and 5xx handshake responses up
+// to ConnectRetries times with the ListenWithReconnect backoff. Other
+// handshake responses mean the session is unusable and are returned
+// straight away.
+func (l *Listener) dial(ctx context.Context, dialer *ws.Dialer, wsURL string, header http.Header) (*ws.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, resp, err := dialer.DialContext(ctx, wsURL, header)
+		status := 0
+		extra := ""
+		if resp != nil {
+			status = resp.StatusCode
+			if resp.Body != nil {
+				if err != nil {
+					b, _ := io.ReadAll(resp.Body)
+					extra = " | " + string(b)
+				}
+				resp.Body.Close()
+			}
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if status != 0 {
+			err = &HandshakeError{StatusCode: status, Err: err}
+		}
+		err = fmt.Errorf("websocket dial: %w%s", err, extra)
+		if attempt > l.cfg.ConnectRetries || ctx.Err() != nil || (status != 0 && status < 500) || certificateError(err) {
+			return nil, err
+		}
+
+		wait := l.backoff(attempt)
+		l.cfg.Logger.Warnf("websocket dial failed, retrying in %s (%d/%d): %v", wait.Round(time.Millisecond), attempt, l.cfg.ConnectRetries, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-l.cfg.Clock.After(wait):
+		}
+	}
+}
+
+func (l *Listener) connected() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn != nil
+}
+
+// offered reports whether the server's choice of subprotocol is one of the
+// ones the dialer asked for.
+func offered(subprotocols []string, got string) bool {
+	for _, p := range subprotocols {
+		if p == got {
+			return true
+		}
+	}
+	return false
+}
+
 // ---------------------------------------------------------------------------
 // Listen – blocking read loop + ping keep-alive
 // ---------------------------------------------------------------------------
@@ -240,37 +1359,220 @@ func (l *Listener) Connect(ctx context.Context) error {
 // Listen runs the event loop. Blocks until ctx is cancelled or an error occurs.
 // Automatically sends ACKs and keep-alive pings.
 func (l *Listener) Listen(ctx context.Context) error {
-	if l.conn == nil {
-		return fmt.Errorf("call Connect before Listen")
+	_, err := l.listen(ctx)
+	l.finish(err)
+	return err
+}
+
+// listen implements Listen and also reports whether it ended through Stop.
+func (l *Listener) listen(ctx context.Context) (stopped bool, err error) {
+	if l.cfgErr != nil {
+		return false, l.cfgErr
+	}
+	// Claim the connection in the same critical section that checks for
+	// it, so that a concurrent Close either sees l.stop and stops this
+	// Listen, or releases the connection before it is claimed.
+	stop := &stopSignal{ch: make(chan struct{})}
+	l.mu.Lock()
+	conn := l.conn
+	if conn != nil {
+		l.stop = stop
+	}
+	l.mu.Unlock()
+	if conn == nil {
+		return false, fmt.Errorf("call Connect before Listen")
 	}
-	defer l.conn.Close()
 
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(withAccount(ctx, l.AccountID()))
 	defer cancel()
+	l.mu.Lock()
+	l.ackTail = nil // ACK order is per connection
+	l.mu.Unlock()
+	l.connEvents.Store(0)
 
-	errCh := make(chan error, 1)
+	errCh := make(chan error, 3)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	l.startPipeline(&wg)
 
 	// Ping loop
 	go func() {
+		defer wg.Done()
 		if err := l.pingLoop(ctx); err != nil {
 			errCh <- err
 		}
 	}()
 
+	if l.cfg.MaxIdle > 0 {
+		l.lastActivity.Store(l.cfg.Clock.Now().UnixNano())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.idleWatchdog(ctx); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+
 	// Read loop
 	go func() {
-		errCh <- l.readLoop(ctx)
+		defer wg.Done()
+		errCh <- l.readLoop(ctx, conn, stop.ch)
+		l.stopPipeline()
 	}()
 
 	select {
 	case <-ctx.Done():
-		l.close()
-		return ctx.Err()
-	case err := <-errCh:
-		cancel()
-		l.close()
-		return err
+		err = ctx.Err()
+	case err = <-errCh:
+	case <-stop.ch:
+	}
+	select {
+	case <-stop.ch:
+		stopped, err = true, stop.err
+	default:
+	}
+	cancel()
+
+	// Unblock the read loop without closing the connection, so that
+	// draining workers and deferred ACKs can still write. Close it only
+	// once both loops and every worker have stopped using it.
+	l.stopReading(conn)
+	wg.Wait()
+	l.close(conn)
+	l.mu.Lock()
+	l.conn = nil
+	l.stop = nil
+	l.mu.Unlock()
+	l.stats.connectedSince.Store(0)
+	l.inflight.clear()
+
+	if l.cfg.OnDisconnect != nil {
+		l.cfg.OnDisconnect(err)
+	}
+	var detail interface{}
+	if err != nil {
+		detail = err.Error()
+	}
+	l.systemEvent(SystemEventDisconnected, map[string]interface{}{"error": detail})
+	return stopped, err
+}
+
+// startPipeline starts the worker pool and batcher, if configured, adding
+// their goroutines to wg.
+func (l *Listener) startPipeline(wg *sync.WaitGroup) {
+	l.workers = nil
+	if l.cfg.Concurrency > 0 {
+		l.workers = newWorkerPool(l.cfg.Concurrency, l.cfg.QueueSize, l.cfg.PreserveOrderByObject)
+		l.workers.start(wg)
+	}
+
+	l.batchIn = nil
+	if bh, ok := l.userHandler().(BatchHandler); ok && l.cfg.BatchSize > 0 {
+		l.batchIn = make(chan batchItem, l.cfg.BatchSize)
+		wg.Add(1)
+		go func(in <-chan batchItem) {
+			defer wg.Done()
+			l.runBatcher(in, bh)
+		}(l.batchIn)
+	}
+}
+
+// stopPipeline stops feeding the pipeline once no more frames will be
+// handled. The goroutines exit after finishing what is queued.
+func (l *Listener) stopPipeline() {
+	if l.workers != nil {
+		// Let the workers drain what was already ACKed.
+		l.workers.close()
+	}
+	if l.batchIn != nil {
+		// Flush the last, partial batch.
+		close(l.batchIn)
+	}
+}
+
+// Stop makes a running Listen return err (which may be nil). Listen first
+// waits for the event currently being handled to finish, and no further
+// events are dispatched. Stop does not block and is a no-op when Listen is
+// not running; only the first call per Listen takes effect.
+//
+// Stop is meant to be called from inside a handler, e.g. on a poison event.
+// Because Listen waits for that handler to return, a handler must never
+// wait for Listen itself to return.
+func (l *Listener) Stop(err error) {
+	l.mu.Lock()
+	stop := l.stop
+	children := l.children
+	l.mu.Unlock()
+	for _, c := range children {
+		c.Stop(err)
+	}
+	if stop == nil {
+		return
+	}
+	stop.once.Do(func() {
+		stop.err = err
+		close(stop.ch)
+	})
+}
+
+type stopSignal struct {
+	once sync.Once
+	ch   chan struct{}
+	err  error
+}
+
+// Close sends a normal-closure close frame on the current connection and
+// shuts it down. If Listen is running, Close stops it as Stop(nil) would:
+// the ping loop ends, in-flight handlers finish and send their deferred
+// ACKs, and Listen then sends the close frame, releases the connection and
+// returns nil. Close does not wait for that, so it is safe to call from a
+// handler. Without a running Listen the connection is released straight
+// away.
+//
+// Close returns the error from writing the close frame, if it wrote one. It
+// is a no-op once the connection is closed, and Connect may open a new one.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	children := l.children
+	conn := l.conn
+	stop := l.stop
+	l.mu.Unlock()
+
+	var firstErr error
+	for _, c := range children {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if conn == nil {
+		return firstErr
+	}
+	if stop != nil {
+		// Listen sends the close frame once its handlers are done.
+		l.Stop(nil)
+		return firstErr
 	}
+
+	msg := ws.FormatCloseMessage(ws.CloseNormalClosure, "done")
+	err := l.writeControl(ws.CloseMessage, msg)
+	if errors.Is(err, ws.ErrCloseSent) || errors.Is(err, ErrNotConnected) {
+		// Already closing.
+		err = nil
+	}
+	l.mu.Lock()
+	if l.conn == conn && l.stop == nil {
+		conn.Close()
+		l.conn = nil
+		l.stats.connectedSince.Store(0)
+		l.inflight.clear()
+	}
+	l.mu.Unlock()
+	if firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
 
 // ---------------------------------------------------------------------------
@@ -278,7 +1580,18 @@ func (l *Listener) Listen(ctx context.Context) error {
 // ---------------------------------------------------------------------------
 
 // ListenAll is a convenience that calls Authorize, Connect, Listen sequentially.
-func (l *Listener) ListenAll(ctx context.Context) error {
+//
+// When several WebSocketFeatures are configured, ListenAll opens one session
+// and connection per feature, as the Stripe CLI does, and multiplexes their
+// events into the same handler; see Sessions.
+func (l *Listener) ListenAll(ctx context.Context) (err error) {
+	defer func() { l.finish(err) }()
+	if l.cfgErr != nil {
+		return l.cfgErr
+	}
+	if len(l.cfg.WebSocketFeatures) > 1 {
+		return l.listenPerFeature(ctx, (*Listener).ListenAll)
+	}
 	if _, err := l.Authorize(ctx); err != nil {
 		return err
 	}
@@ -288,97 +1601,477 @@ func (l *Listener) ListenAll(ctx context.Context) error {
 	return l.Listen(ctx)
 }
 
+// ListenAllFunc runs ListenAll on a Listener with default settings that
+// passes every v1 webhook event to fn. It is meant for quick scripts; use
+// New for anything else.
+func ListenAllFunc(ctx context.Context, apiKey string, fn func(StripeEventPayload)) error {
+	return New(Config{
+		APIKey:    apiKey,
+		OnWebhook: func(_ WebhookEvent, parsed StripeEventPayload) { fn(parsed) },
+	}).ListenAll(ctx)
+}
+
 // ---------------------------------------------------------------------------
 // Internals
 // ---------------------------------------------------------------------------
 
-func (l *Listener) readLoop(ctx context.Context) error {
-	l.conn.SetPongHandler(func(string) error {
-		return l.conn.SetReadDeadline(time.Now().Add(l.cfg.PongWait))
+func (l *Listener) readLoop(ctx context.Context, conn *ws.Conn, stop <-chan struct{}) error {
+	conn.SetPongHandler(func(string) error {
+		now := l.cfg.Clock.Now()
+		l.lastPong.Store(now.UnixNano())
+		l.lastActivity.Store(now.UnixNano())
+		return l.extendRead(ctx, conn)
 	})
+	if l.cfg.MaxMessageBytes > 0 {
+		conn.SetReadLimit(l.cfg.MaxMessageBytes)
+	}
+	l.stats.readLimit.Store(l.cfg.MaxMessageBytes)
 
 	for {
-		if err := l.conn.SetReadDeadline(time.Now().Add(l.cfg.PongWait)); err != nil {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err := l.extendRead(ctx, conn); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return fmt.Errorf("set read deadline: %w", err)
 		}
 
-		_, data, err := l.conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if ctx.Err() != nil {
 				return nil
 			}
-			if ws.IsCloseError(err, ws.CloseNormalClosure) {
-				return nil
+			var ce *ws.CloseError
+			if errors.As(err, &ce) {
+				if ce.Code == ws.CloseNormalClosure {
+					return nil
+				}
+				return &ConnectionClosedError{Code: ce.Code, Text: ce.Text}
 			}
 			return fmt.Errorf("read: %w", err)
 		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		l.stats.recordMessage(len(data))
+		l.lastActivity.Store(l.cfg.Clock.Now().UnixNano())
 
-		var msg IncomingMessage
-		if err := json.Unmarshal(data, &msg); err != nil {
-			l.cfg.Logger.Warnf("malformed message: %v", err)
-			continue
+		if !l.handleFrame(ctx, data, false) {
+			return nil
 		}
+	}
+}
 
-		switch {
-		case msg.WebhookEvent != nil:
-			var parsed StripeEventPayload
-			_ = json.Unmarshal([]byte(msg.WebhookEvent.EventPayload), &parsed)
-			l.sendACK(parsed.ID, msg.WebhookEvent.WebhookConversationID, msg.WebhookEvent.WebhookID)
-			l.cfg.Handler.OnWebhookEvent(*msg.WebhookEvent, parsed)
+// extendRead moves conn's read deadline PongWait ahead. Once ctx is done it
+// returns ctx.Err() instead, so it can't undo stopReading.
+func (l *Listener) extendRead(ctx context.Context, conn *ws.Conn) error {
+	l.rmu.Lock()
+	defer l.rmu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(l.cfg.Clock.Now().Add(l.cfg.PongWait))
+}
 
-		case msg.V2Event != nil:
-			var parsed V2EventPayload
-			_ = json.Unmarshal([]byte(msg.V2Event.Payload), &parsed)
-			l.sendACK(parsed.ID, "", msg.V2Event.EventDestinationID)
-			l.cfg.Handler.OnV2Event(*msg.V2Event, parsed)
+// stopReading makes a blocked read on conn fail straight away while leaving
+// it open for writes. Listen cancels the read loop's ctx first.
+func (l *Listener) stopReading(conn *ws.Conn) {
+	l.rmu.Lock()
+	defer l.rmu.Unlock()
+	_ = conn.SetReadDeadline(time.Unix(1, 0))
+}
 
-		default:
-			l.cfg.Handler.OnUnknownMessage(msg.RawType, msg.RawData)
+// handleFrame decodes one frame and ACKs and dispatches it. It returns
+// false once ctx is done and the caller should stop. For ReplayFile, replay
+// skips everything that needs the connection or records the frame: ACKs,
+// forwarding, Sink, and leaving events un-ACKed while paused.
+func (l *Listener) handleFrame(ctx context.Context, data []byte, replay bool) bool {
+	var msg IncomingMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		l.cfg.Logger.Warnf("malformed message: %v", err)
+		l.reportError(&MalformedMessageError{Data: data, Err: err})
+		if l.cfg.OnMalformed != nil {
+			l.cfg.OnMalformed(data, err)
+		}
+		return true
+	}
+	if (msg.WebhookEvent != nil || msg.V2Event != nil) && l.paused.Load() && !replay {
+		l.cfg.Logger.Debugf("paused; leaving %s un-ACKed", msg.RawType)
+		return true
+	}
+	if (msg.WebhookEvent != nil || msg.V2Event != nil) && l.maxEventsReached() {
+		// Another connection reached MaxEvents; leave this one un-ACKed.
+		return false
+	}
+
+	switch {
+	case msg.WebhookEvent != nil:
+		var parsed StripeEventPayload
+		parseErr := json.Unmarshal([]byte(msg.WebhookEvent.EventPayload), &parsed)
+		if parseErr != nil {
+			l.cfg.Logger.Warnf("malformed event payload (webhook %s): %v", msg.WebhookEvent.WebhookID, parseErr)
+			l.reportError(&MalformedMessageError{Kind: msg.RawType, Data: data, Err: parseErr})
+		}
+		receivedAt := l.cfg.Clock.Now()
+		msg.WebhookEvent.ReceivedAt = receivedAt
+		msg.WebhookEvent.origin = l
+		if !replay {
+			l.inflight.add(msg.WebhookEvent.WebhookConversationID, receivedAt)
+		}
+		l.cfg.AuditSink.RecordReceived(AuditEvent{ID: parsed.ID, Type: parsed.Type, Kind: msg.RawType, ReceivedAt: receivedAt})
+		l.cfg.Metrics.IncEvent(parsed.Type)
+		l.stats.recordEvent(receivedAt)
+		if !replay {
+			l.dumpEvent(parsed.ID, parsed.Type, msg.RawType, msg.WebhookEvent.EventPayload, receivedAt)
+		}
+		l.logw(levelDebug, "event received", map[string]interface{}{"id": parsed.ID, "type": parsed.Type, "kind": msg.RawType})
+		if l.recent != nil {
+			l.recent.add(*msg.WebhookEvent)
+		}
+		traced := l.trace.take(parsed.ID, receivedAt)
+		if traced {
+			l.cfg.Logger.Infof("trace %s: frame %s", parsed.ID, data)
+			l.cfg.Logger.Infof("trace %s: parsed type=%s account=%q created=%d", parsed.ID, parsed.Type, parsed.Account, parsed.Created)
+		}
+		ack := func() {
+			if l.cfg.DisableAutoACK || replay {
+				return
+			}
+			err := l.sendACK(parsed.ID, msg.WebhookEvent.WebhookConversationID, msg.WebhookEvent.WebhookID)
+			if traced {
+				l.cfg.Logger.Infof("trace %s: ack conversation=%s webhook=%s err=%v", parsed.ID, msg.WebhookEvent.WebhookConversationID, msg.WebhookEvent.WebhookID, err)
+			}
+		}
+		if parseErr != nil {
+			if eh, ok := l.userHandler().(EventErrorHandler); ok {
+				if l.cfg.RateLimitACK && l.throttle(ctx) != nil {
+					return false
+				}
+				l.ackInOrder(ctx, parsed.ID, ack)
+				evt := *msg.WebhookEvent
+				l.dispatch("", l.throttled(ctx, func() { eh.OnEventError(evt, parseErr) }))
+				return l.countDispatched()
+			}
+		}
+		skip := l.skipWebhook(parsed)
+		acker, deferACK := l.userHandler().(WebhookACKHandler)
+		if l.batchIn != nil {
+			deferACK = l.cfg.BatchACKAfterFlush
+		}
+		if skip == "" && l.cfg.RateLimitACK && l.throttle(ctx) != nil {
+			// Left un-ACKed, so its redelivery must not count as a
+			// duplicate.
+			l.forgetDuplicate(parsed.ID)
+			return false
+		}
+		if !deferACK || parseErr != nil || skip != "" {
+			deferACK = false
+			l.ackInOrder(ctx, parsed.ID, ack)
+		}
+		if skip != "" {
+			l.cfg.AuditSink.RecordSkipped(parsed.ID, skip, l.cfg.Clock.Now())
+			return true
+		}
+		if l.cfg.ForwardTo != "" && !replay {
+			l.mu.Lock()
+			conn := l.conn
+			l.mu.Unlock()
+			go l.forward(ctx, conn, *msg.WebhookEvent, parsed.ID, l.signingSecret())
+		}
+		evt := *msg.WebhookEvent
+		if l.batchIn != nil {
+			if !l.cfg.RateLimitACK {
+				// Hand the event over even if ctx ends while waiting.
+				_ = l.throttle(ctx)
+			}
+			it := batchItem{evt: evt, id: parsed.ID}
+			if deferACK {
+				it.ack = l.deferACK(ctx, parsed.ID, ack)
+			}
+			// The event may already be ACKed, so hand it over even while
+			// shutting down; the batcher flushes it before exiting.
+			l.batchIn <- it
+			return l.countDispatched()
+		}
+		objectID, _ := parsed.Object()["id"].(string)
+		if deferACK {
+			d := l.deferACK(ctx, parsed.ID, ack)
+			l.dispatch(objectID, l.throttled(ctx, func() {
+				hctx, cancel := l.handlerContext(ctx, parsed.ID, parsed.Type)
+				defer cancel()
+				if err := acker.HandleWebhookEvent(hctx, evt, parsed); err != nil {
+					if !d.decline() {
+						l.cfg.Logger.Warnf("handler failed for %s after it was ACKed by ACKAfter; Stripe will not redeliver it: %v", parsed.ID, err)
+						return
+					}
+					l.cfg.Logger.Infof("not acking %s, Stripe will redeliver it: %v", parsed.ID, err)
+					l.forgetDuplicate(parsed.ID)
+					l.inflight.remove(evt.WebhookConversationID)
+					return
+				}
+				d.confirm()
+			}))
+			return l.countDispatched()
+		}
+		l.dispatch(objectID, l.throttled(ctx, func() {
+			hctx, cancel := l.handlerContext(ctx, parsed.ID, parsed.Type)
+			defer cancel()
+			l.handler.OnWebhookEvent(hctx, evt, parsed)
+		}))
+		return l.countDispatched()
+
+	case msg.V2Event != nil:
+		var parsed V2EventPayload
+		if err := json.Unmarshal([]byte(msg.V2Event.Payload), &parsed); err != nil {
+			l.cfg.Logger.Warnf("malformed v2 event payload (destination %s): %v", msg.V2Event.EventDestinationID, err)
+			l.reportError(&MalformedMessageError{Kind: msg.RawType, Data: data, Err: err})
+		}
+		receivedAt := l.cfg.Clock.Now()
+		msg.V2Event.ReceivedAt = receivedAt
+		msg.V2Event.origin = l
+		l.cfg.AuditSink.RecordReceived(AuditEvent{ID: parsed.ID, Type: parsed.Type, Kind: msg.RawType, ReceivedAt: receivedAt})
+		l.cfg.Metrics.IncEvent(parsed.Type)
+		l.stats.recordEvent(receivedAt)
+		if !replay {
+			l.dumpEvent(parsed.ID, parsed.Type, msg.RawType, msg.V2Event.Payload, receivedAt)
+		}
+		l.logw(levelDebug, "event received", map[string]interface{}{"id": parsed.ID, "type": parsed.Type, "kind": msg.RawType})
+		traced := l.trace.take(parsed.ID, receivedAt)
+		if traced {
+			l.cfg.Logger.Infof("trace %s: frame %s", parsed.ID, data)
+			l.cfg.Logger.Infof("trace %s: parsed type=%s created=%s", parsed.ID, parsed.Type, parsed.Created)
+		}
+		if l.cfg.RateLimitACK && l.throttle(ctx) != nil {
+			return false
+		}
+		if !l.cfg.DisableAutoACK && !replay {
+			err := l.sendACK(parsed.ID, "", msg.V2Event.EventDestinationID)
+			if traced {
+				l.cfg.Logger.Infof("trace %s: ack destination=%s err=%v", parsed.ID, msg.V2Event.EventDestinationID, err)
+			}
+		}
+		if l.duplicate(parsed.ID) {
+			l.cfg.Logger.Debugf("dropping duplicate %s", parsed.ID)
+			l.cfg.AuditSink.RecordSkipped(parsed.ID, "duplicate", l.cfg.Clock.Now())
+			return true
+		}
+		if !l.acceptLivemode(parsed.Livemode) {
+			l.cfg.Logger.Debugf("skipping %s with livemode=%t", parsed.ID, parsed.Livemode)
+			l.cfg.AuditSink.RecordSkipped(parsed.ID, "livemode filter", l.cfg.Clock.Now())
+			return true
+		}
+		if !l.acceptDestination(msg.V2Event.EventDestinationID) {
+			l.cfg.Logger.Debugf("skipping %s from destination %s", parsed.ID, msg.V2Event.EventDestinationID)
+			l.cfg.AuditSink.RecordSkipped(parsed.ID, "destination filter", l.cfg.Clock.Now())
+			return true
+		}
+		if !l.acceptType(parsed.Type) {
+			l.cfg.Logger.Debugf("skipping %s of type %s", parsed.ID, parsed.Type)
+			l.cfg.AuditSink.RecordSkipped(parsed.ID, "event type filter", l.cfg.Clock.Now())
+			return true
+		}
+		evt := *msg.V2Event
+		objectID := parsed.ID
+		if parsed.RelatedObject != nil && parsed.RelatedObject.ID != "" {
+			objectID = parsed.RelatedObject.ID
+		}
+		l.dispatch(objectID, l.throttled(ctx, func() {
+			hctx, cancel := l.handlerContext(ctx, parsed.ID, parsed.Type)
+			defer cancel()
+			l.handler.OnV2Event(hctx, evt, parsed)
+		}))
+		return l.countDispatched()
+
+	default:
+		rawType, rawData := msg.RawType, msg.RawData
+		if uh, ok := l.userHandler().(UnknownMessageHandler); ok {
+			um := newUnknownMessage(rawType, rawData)
+			l.dispatch("", func() { uh.HandleUnknownMessage(ctx, um) })
+		} else {
+			l.dispatch("", func() { l.handler.OnUnknownMessage(ctx, rawType, rawData) })
 		}
 	}
+	return true
 }
 
-func (l *Listener) pingLoop(ctx context.Context) error {
-	ticker := time.NewTicker(l.cfg.PingPeriod)
-	defer ticker.Stop()
+// countDispatched counts an event handed to the handler. Once MaxEvents
+// is reached it stops Listen and reports false.
+func (l *Listener) countDispatched() bool {
+	if n := l.connEvents.Add(1); n == int64(l.cfg.MaxEventsPerConnection) && l.requestRotation() {
+		l.cfg.Logger.Infof("rotating connection after %d events (MaxEventsPerConnection)", n)
+	}
+	if l.cfg.MaxEvents <= 0 || l.eventCount.Add(1) < int64(l.cfg.MaxEvents) {
+		return true
+	}
+	l.cfg.Logger.Infof("dispatched MaxEvents (%d) events; stopping", l.cfg.MaxEvents)
+	l.Stop(nil)
+	return false
+}
+
+func (l *Listener) maxEventsReached() bool {
+	return l.cfg.MaxEvents > 0 && l.eventCount.Load() >= int64(l.cfg.MaxEvents)
+}
+
+// userHandler returns the handler as configured, for optional interface
+// checks.
+func (l *Listener) userHandler() interface{} {
+	if l.cfg.Handler != nil {
+		return l.cfg.Handler
+	}
+	return l.cfg.HandlerContext
+}
+
+// signingSecret returns the secret used to sign forwarded events.
+func (l *Listener) signingSecret() string {
+	if l.cfg.SigningSecret != "" {
+		return l.cfg.SigningSecret
+	}
+	if s := l.Session(); s != nil {
+		return s.Secret
+	}
+	return ""
+}
+
+// systemEvent delivers a lifecycle transition if enabled and supported.
+func (l *Listener) systemEvent(kind string, detail map[string]interface{}) {
+	if !l.cfg.DeliverLifecycleEvents {
+		return
+	}
+	if h, ok := l.userHandler().(SystemEventHandler); ok {
+		h.OnSystemEvent(kind, detail)
+	}
+}
 
+func (l *Listener) pingLoop(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticker.C:
-			l.mu.Lock()
-			err := l.conn.WriteControl(ws.PingMessage, nil, time.Now().Add(l.cfg.WriteWait))
-			l.mu.Unlock()
-			if err != nil {
+		case <-l.cfg.Clock.After(l.pingInterval()):
+			if err := l.writeControl(ws.PingMessage, nil); err != nil {
 				return fmt.Errorf("ping: %w", err)
 			}
+			l.stats.pingsSent.Add(1)
 		}
 	}
 }
 
-func (l *Listener) sendACK(eventID, conversationID, webhookID string) {
+// pingInterval returns the wait before the next ping: PingPeriod, jittered
+// by up to PingJitter either way.
+func (l *Listener) pingInterval() time.Duration {
+	j := l.cfg.PingJitter
+	if j <= 0 {
+		return l.cfg.PingPeriod
+	}
+	return l.cfg.PingPeriod - j + time.Duration(rand.Int63n(int64(2*j)+1))
+}
+
+func (l *Listener) sendACK(eventID, conversationID, webhookID string) error {
+	err := l.writeACK(eventID, conversationID, webhookID)
+	if err == nil && conversationID != "" {
+		l.inflight.remove(conversationID)
+	}
+	if l.cfg.OnACK != nil {
+		l.cfg.OnACK(eventID, err)
+	}
+	return err
+}
+
+func (l *Listener) writeACK(eventID, conversationID, webhookID string) error {
 	ack := EventAck{
-		Type:                  "event_ack",
+		Type:                  MsgTypeEventAck,
 		EventID:               eventID,
 		WebhookConversationID: conversationID,
 		WebhookID:             webhookID,
 	}
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if err := l.conn.WriteJSON(ack); err != nil {
+	data, err := json.Marshal(ack)
+	if err != nil {
+		l.cfg.Logger.Warnf("ack encode failed for %s: %v", eventID, err)
+		l.cfg.Metrics.IncACKFailure()
+		l.stats.ackFailures.Add(1)
+		l.reportError(&ACKError{EventID: eventID, Err: err})
+		return err
+	}
+	if err := l.writeMessage(ws.TextMessage, data); err != nil {
 		l.cfg.Logger.Warnf("ack send failed for %s: %v", eventID, err)
+		l.cfg.Metrics.IncACKFailure()
+		l.stats.ackFailures.Add(1)
+		l.reportError(&ACKError{EventID: eventID, Err: err})
+		return err
 	}
+	l.stats.eventsACKed.Add(1)
+	l.cfg.AuditSink.RecordAcked(eventID, l.cfg.Clock.Now())
+	return nil
 }
 
-func (l *Listener) close() {
-	if l.conn != nil {
-		msg := ws.FormatCloseMessage(ws.CloseNormalClosure, "done")
-		_ = l.conn.WriteControl(ws.CloseMessage, msg, time.Now().Add(l.cfg.WriteWait))
-		time.Sleep(500 * time.Millisecond)
-		l.conn.Close()
+// writeMessage writes a data frame under the write lock.
+func (l *Listener) writeMessage(messageType int, data []byte) error {
+	return l.writeMessageTo(nil, messageType, data)
+}
+
+// writeMessageTo is writeMessage limited to want: it returns
+// ErrNotConnected once want is no longer the current connection. A nil
+// want matches any connection.
+func (l *Listener) writeMessageTo(want *ws.Conn, messageType int, data []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	conn := l.writeConn(want, messageType, data)
+	if conn == nil {
+		return ErrNotConnected
 	}
+	if err := conn.SetWriteDeadline(l.cfg.Clock.Now().Add(l.cfg.WriteWait)); err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	l.stats.bytesSent.Add(int64(len(data)))
+	return nil
+}
+
+// writeControl writes a control frame (ping, close) under the write lock.
+func (l *Listener) writeControl(messageType int, data []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+
+	conn := l.writeConn(nil, messageType, data)
+	if conn == nil {
+		return ErrNotConnected
+	}
+	if err := conn.WriteControl(messageType, data, l.cfg.Clock.Now().Add(l.cfg.WriteWait)); err != nil {
+		return err
+	}
+	l.stats.bytesSent.Add(int64(len(data)))
+	return nil
+}
+
+// writeConn returns the connection to write to, or nil if there is none or
+// it isn't want, and passes the frame to OnOutgoingFrame. The caller holds
+// wmu; mu is released before the hook runs so that it may call into the
+// Listener.
+func (l *Listener) writeConn(want *ws.Conn, messageType int, data []byte) *ws.Conn {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if want != nil && conn != want {
+		return nil
+	}
+	if conn != nil && l.cfg.OnOutgoingFrame != nil {
+		l.cfg.OnOutgoingFrame(messageType, data)
+	}
+	return conn
+}
+
+func (l *Listener) close(conn *ws.Conn) {
+	msg := ws.FormatCloseMessage(ws.CloseNormalClosure, "done")
+	_ = l.writeControl(ws.CloseMessage, msg)
+	time.Sleep(500 * time.Millisecond)
+	conn.Close()
 }
 
 // ---------------------------------------------------------------------------
@@ -387,13 +2080,24 @@ func (l *Listener) close() {
 // Source: https://github.com/stripe/stripe-cli/blob/master/pkg/useragent/useragent.go#L56-L73
 // ---------------------------------------------------------------------------
 
-func setHeaders(h http.Header, apiKey string) {
+// addExtraHeaders merges Config.ExtraHeaders into h.
+func (l *Listener) addExtraHeaders(h http.Header) {
+	for k, vs := range l.cfg.ExtraHeaders {
+		k = http.CanonicalHeaderKey(k)
+		if _, set := h[k]; set && !l.cfg.ExtraHeadersOverride {
+			continue
+		}
+		h[k] = append([]string(nil), vs...)
+	}
+}
+
+func setHeaders(h http.Header, apiKey, version string) {
 	h.Set("Accept-Encoding", "identity")
-	h.Set("User-Agent", "Stripe/v1 stripe-cli/"+cliVersion)
+	h.Set("User-Agent", "Stripe/v1 stripe-cli/"+version)
 
 	ua, _ := json.Marshal(map[string]string{
 		"name":      "stripe-cli",
-		"version":   cliVersion,
+		"version":   version,
 		"publisher": "stripe",
 		"os":        runtime.GOOS,
 		"uname":     runtime.GOOS + " " + runtime.GOARCH,
@@ -0,0 +1,1127 @@
+package stripelistener_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	sl "github.com/kmoz000/stripelistener/go"
+	"github.com/kmoz000/stripelistener/go/testutil"
+)
+
+// recorder is an EventHandler that remembers the IDs of the events it was
+// given.
+type recorder struct {
+	mu    sync.Mutex
+	delay time.Duration
+	v1    []string
+	v2    []string
+}
+
+func (r *recorder) OnWebhookEvent(_ sl.WebhookEvent, p sl.StripeEventPayload) {
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v1 = append(r.v1, p.ID)
+}
+
+func (r *recorder) OnV2Event(_ sl.V2Event, p sl.V2EventPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v2 = append(r.v2, p.ID)
+}
+
+func (r *recorder) OnUnknownMessage(string, json.RawMessage) {}
+
+func (r *recorder) handled() (v1, v2 []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.v1...), append([]string(nil), r.v2...)
+}
+
+// acked returns the event IDs the client has ACKed to srv.
+func acked(srv *testutil.MockServer) []string {
+	var ids []string
+	for _, f := range srv.Received() {
+		var ack sl.EventAck
+		if json.Unmarshal(f, &ack) == nil && ack.Type == sl.MsgTypeEventAck {
+			ids = append(ids, ack.EventID)
+		}
+	}
+	return ids
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// listen runs ListenAll in the background and returns a function that
+// cancels it and waits for it to return.
+func listen(t *testing.T, l *sl.Listener) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.ListenAll(ctx)
+	}()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenAll did not return after cancel")
+		}
+	}
+}
+
+// listenWithReconnect is listen for ListenWithReconnect.
+func listenWithReconnect(t *testing.T, l *sl.Listener) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.ListenWithReconnect(ctx)
+	}()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenWithReconnect did not return after cancel")
+		}
+	}
+}
+
+func TestLiveModeOnlyFiltersV2Events(t *testing.T) {
+	tests := []struct {
+		name     string
+		only     *bool
+		expected []string
+	}{
+		{"both modes", nil, []string{"evt_test", "evt_live"}},
+		{"live only", sl.Bool(true), []string{"evt_live"}},
+		{"test only", sl.Bool(false), []string{"evt_test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			rec := &recorder{}
+			cfg.Handler = rec
+			cfg.LiveModeOnly = tt.only
+			l := sl.New(cfg)
+			stop := listen(t, l)
+			defer stop()
+
+			srv.Push(testutil.V2EventFrame(`{"id":"evt_test","object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":false,"created":"2024-09-17T06:20:52.246Z"}`))
+			srv.Push(testutil.V2EventFrame(`{"id":"evt_live","object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":true,"created":"2024-09-17T06:20:53.246Z"}`))
+			waitFor(t, "both events to be ACKed", func() bool { return len(acked(srv)) == 2 })
+			stop()
+
+			_, got := rec.handled()
+			if len(got) != len(tt.expected) {
+				t.Fatalf("handled %v, want %v", got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Fatalf("handled %v, want %v", got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectTwice(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	cfg.Handler = &recorder{}
+	l := sl.New(cfg)
+	ctx := context.Background()
+
+	if _, err := l.Authorize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Connect(ctx); !errors.Is(err, sl.ErrAlreadyConnected) {
+		t.Fatalf("second Connect = %v, want ErrAlreadyConnected", err)
+	}
+	waitFor(t, "the first connection to be served", func() bool { return srv.OpenConnections() == 1 })
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "every connection to close", func() bool { return srv.OpenConnections() == 0 })
+
+	// The Listener is usable again once the connection is released.
+	if err := l.Connect(ctx); err != nil {
+		t.Fatalf("Connect after Close: %v", err)
+	}
+	defer l.Close()
+	waitFor(t, "the new connection to be served", func() bool { return srv.OpenConnections() == 1 })
+}
+
+func TestCloseRacesListen(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	cfg.Handler = &recorder{}
+	l := sl.New(cfg)
+	ctx := context.Background()
+	if _, err := l.Authorize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close lands at varying points of Listen's startup; it must either
+	// stop Listen or make it fail, never pull the connection from under it.
+	for i := 0; i < 10; i++ {
+		if err := l.Connect(ctx); err != nil {
+			t.Fatalf("Connect #%d: %v", i, err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- l.Listen(ctx) }()
+		time.Sleep(time.Duration(i%5) * time.Microsecond)
+		l.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listen #%d did not return after Close", i)
+		}
+		waitFor(t, "the connection to close", func() bool { return srv.OpenConnections() == 0 })
+	}
+}
+
+func TestRequireSubprotocol(t *testing.T) {
+	tests := []struct {
+		name        string
+		subprotocol string // requested; the mock server only speaks sl.Subprotocol
+		require     *bool
+		wantErr     bool
+	}{
+		{"negotiated", "", nil, false},
+		{"omitted by server", "stripecli-devproxy-v2", nil, true},
+		{"omitted but not required", "stripecli-devproxy-v2", sl.Bool(false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			cfg.Handler = &recorder{}
+			cfg.Subprotocol = tt.subprotocol
+			cfg.RequireSubprotocol = tt.require
+			l := sl.New(cfg)
+			ctx := context.Background()
+			if _, err := l.Authorize(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			err := l.Connect(ctx)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "did not negotiate subprotocol") {
+					t.Fatalf("Connect = %v, want a subprotocol error", err)
+				}
+				waitFor(t, "the rejected connection to close", func() bool { return srv.OpenConnections() == 0 })
+				return
+			}
+			if err != nil {
+				t.Fatalf("Connect = %v", err)
+			}
+			l.Close()
+		})
+	}
+}
+
+func TestRequireSubprotocolCustomDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  []string // subprotocols the mock server agrees to
+		wantErr bool
+	}{
+		{"offered by dialer", []string{"custom-v2"}, false},
+		{"not offered", []string{sl.Subprotocol}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			srv.SetSubprotocols(tt.server...)
+			cfg.Handler = &recorder{}
+			cfg.Dialer = &ws.Dialer{Subprotocols: []string{"custom-v2"}}
+			l := sl.New(cfg)
+			ctx := context.Background()
+			if _, err := l.Authorize(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			err := l.Connect(ctx)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "did not negotiate subprotocol") {
+					t.Fatalf("Connect = %v, want a subprotocol error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Connect = %v", err)
+			}
+			l.Close()
+		})
+	}
+}
+
+// pushEvents pushes n customer.created events and returns their IDs.
+func pushEvents(srv *testutil.MockServer, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("evt_%d", i)
+		srv.Push(testutil.WebhookEventFrame(ids[i], fmt.Sprintf(`{"id":%q,"object":"event","type":"customer.created","created":1726554052,"data":{"object":{"id":"cus_%d","object":"customer"}}}`, ids[i], i)))
+	}
+	return ids
+}
+
+// checkAllACKedHandled fails unless every event ACKed to srv was handled.
+func checkAllACKedHandled(t *testing.T, srv *testutil.MockServer, rec *recorder) {
+	t.Helper()
+	handled, _ := rec.handled()
+	seen := make(map[string]bool, len(handled))
+	for _, id := range handled {
+		seen[id] = true
+	}
+	for _, id := range acked(srv) {
+		if !seen[id] {
+			t.Errorf("%s was ACKed but never handled (handled %v)", id, handled)
+		}
+	}
+}
+
+func TestShutdownHandlesQueuedEvents(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &recorder{delay: 200 * time.Millisecond}
+	cfg.Handler = rec
+	cfg.Concurrency = 1
+	cfg.QueueSize = 1
+	l := sl.New(cfg)
+	stop := listen(t, l)
+	defer stop()
+
+	// One event runs, one is queued and the read loop waits to queue the
+	// third, which is already ACKed.
+	pushEvents(srv, 3)
+	waitFor(t, "three ACKs", func() bool { return len(acked(srv)) == 3 })
+	stop()
+	checkAllACKedHandled(t, srv, rec)
+}
+
+func TestRateLimitShutdownHandlesACKedEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		acks        int // ACKs to wait for before shutting down
+	}{
+		// Inline, the read loop waits in the second handler call.
+		{"inline", 0, 2},
+		// With workers every event is ACKed and queued straight away.
+		{"workers", 2, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			rec := &recorder{}
+			cfg.Handler = rec
+			cfg.RateLimit = 1
+			cfg.Concurrency = tt.concurrency
+			l := sl.New(cfg)
+			stop := listen(t, l)
+			defer stop()
+
+			pushEvents(srv, 5)
+			waitFor(t, "ACKs", func() bool { return len(acked(srv)) >= tt.acks })
+			stop()
+			checkAllACKedHandled(t, srv, rec)
+		})
+	}
+}
+
+// ackingRecorder defers each ACK until its handler has returned.
+type ackingRecorder struct {
+	recorder
+	started chan struct{}
+}
+
+func (r *ackingRecorder) HandleWebhookEvent(_ context.Context, evt sl.WebhookEvent, p sl.StripeEventPayload) error {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	r.OnWebhookEvent(evt, p)
+	return nil
+}
+
+// checkAllHandledACKed fails unless every event handled was ACKed to srv.
+func checkAllHandledACKed(t *testing.T, srv *testutil.MockServer, rec *ackingRecorder) {
+	t.Helper()
+	handled, _ := rec.handled()
+	if len(handled) == 0 {
+		t.Fatal("no events were handled")
+	}
+	waitFor(t, "every handled event to be ACKed", func() bool {
+		seen := make(map[string]bool)
+		for _, id := range acked(srv) {
+			seen[id] = true
+		}
+		for _, id := range handled {
+			if !seen[id] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestStopSendsDeferredACKs(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &ackingRecorder{recorder: recorder{delay: 100 * time.Millisecond}, started: make(chan struct{}, 1)}
+	cfg.Handler = rec
+	cfg.Concurrency = 2
+	l := sl.New(cfg)
+	done := make(chan error, 1)
+	go func() { done <- l.ListenAll(context.Background()) }()
+
+	pushEvents(srv, 4)
+	<-rec.started
+	l.Stop(nil)
+	if err := <-done; err != nil {
+		t.Fatalf("ListenAll = %v", err)
+	}
+	checkAllHandledACKed(t, srv, rec)
+}
+
+func TestMaxEventsACKsEveryEvent(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &ackingRecorder{recorder: recorder{delay: 50 * time.Millisecond}, started: make(chan struct{}, 1)}
+	cfg.Handler = rec
+	cfg.Concurrency = 3
+	cfg.MaxEvents = 3
+	l := sl.New(cfg)
+
+	ids := pushEvents(srv, 3)
+	if err := l.ListenAll(context.Background()); err != nil {
+		t.Fatalf("ListenAll = %v", err)
+	}
+	if handled, _ := rec.handled(); len(handled) != len(ids) {
+		t.Fatalf("handled %v, want %v", handled, ids)
+	}
+	checkAllHandledACKed(t, srv, rec)
+}
+
+func TestRateLimitACKCancelledEventIsRedelivered(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &recorder{}
+	cfg.Handler = rec
+	cfg.DedupWindow = time.Minute
+	cfg.RateLimit = 1
+	cfg.RateLimitACK = true
+	l := sl.New(cfg)
+
+	// evt_1 waits for the limiter behind evt_0 when Listen is cancelled,
+	// so it is left un-ACKed.
+	stop := listen(t, l)
+	pushEvents(srv, 2)
+	waitFor(t, "both events to be received", func() bool { return l.Stats().EventsReceived == 2 })
+	stop()
+	if got := acked(srv); len(got) != 1 || got[0] != "evt_0" {
+		t.Fatalf("ACKed %v, want [evt_0]", got)
+	}
+
+	// Its redelivery must not be dropped as a duplicate.
+	stop = listen(t, l)
+	defer stop()
+	pushEvents(srv, 2)
+	waitFor(t, "the redelivered evt_1 to be handled", func() bool {
+		handled, _ := rec.handled()
+		return len(handled) == 2 && handled[1] == "evt_1"
+	})
+}
+
+// v2OrderRecorder records v2 event IDs per related object. Earlier events
+// take longer, so that unordered dispatch would reorder them.
+type v2OrderRecorder struct {
+	recorder
+	byObject map[string][]string
+}
+
+func (r *v2OrderRecorder) OnV2Event(_ sl.V2Event, p sl.V2EventPayload) {
+	var n int
+	fmt.Sscanf(p.ID, "evt_%d", &n)
+	time.Sleep(time.Duration(12-n) * 5 * time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v2 = append(r.v2, p.ID)
+	r.byObject[p.RelatedObject.ID] = append(r.byObject[p.RelatedObject.ID], p.ID)
+}
+
+func TestPreserveOrderByObjectV2(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &v2OrderRecorder{byObject: make(map[string][]string)}
+	cfg.Handler = rec
+	cfg.Concurrency = 4
+	cfg.PreserveOrderByObject = true
+	l := sl.New(cfg)
+	stop := listen(t, l)
+	defer stop()
+
+	want := make(map[string][]string)
+	for i := 0; i < 12; i++ {
+		id, obj := fmt.Sprintf("evt_%d", i), fmt.Sprintf("mtr_%d", i%2)
+		want[obj] = append(want[obj], id)
+		srv.Push(testutil.V2EventFrame(fmt.Sprintf(`{"id":%q,"object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":false,"created":"2024-09-17T06:20:52.246Z","related_object":{"id":%q,"type":"billing.meter","url":"/v1/billing/meters/%s"}}`, id, obj, obj)))
+	}
+	waitFor(t, "every event to be handled", func() bool {
+		_, v2 := rec.handled()
+		return len(v2) == 12
+	})
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for obj, ids := range want {
+		if got := rec.byObject[obj]; fmt.Sprint(got) != fmt.Sprint(ids) {
+			t.Errorf("%s handled in order %v, want %v", obj, got, ids)
+		}
+	}
+}
+
+// systemRecorder also records lifecycle events.
+type systemRecorder struct {
+	recorder
+	events []systemEvent
+}
+
+type systemEvent struct {
+	kind   string
+	detail map[string]interface{}
+}
+
+func (r *systemRecorder) OnSystemEvent(kind string, detail map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, systemEvent{kind, detail})
+}
+
+// system returns the lifecycle events of the given kind seen so far.
+func (r *systemRecorder) system(kind string) []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var details []map[string]interface{}
+	for _, e := range r.events {
+		if e.kind == kind {
+			details = append(details, e.detail)
+		}
+	}
+	return details
+}
+
+func TestSystemEventReconnecting(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	waitFor(t, "the first connection", func() bool { return srv.OpenConnections() == 1 })
+	srv.Disconnect(ws.CloseGoingAway, "bye")
+	waitFor(t, "a reconnecting event", func() bool { return len(rec.system(sl.SystemEventReconnecting)) == 1 })
+
+	d := rec.system(sl.SystemEventReconnecting)[0]
+	if d["attempt"] != 1 {
+		t.Errorf("attempt = %v, want 1", d["attempt"])
+	}
+	// The mock session's reconnect_delay is 1s, jittered down by up to half.
+	if wait, _ := d["wait"].(time.Duration); wait < 500*time.Millisecond || wait > time.Second {
+		t.Errorf("wait = %v, want 500ms-1s", d["wait"])
+	}
+	if e, _ := d["error"].(string); !strings.Contains(e, "1001") {
+		t.Errorf("error = %v, want the 1001 close", d["error"])
+	}
+	waitFor(t, "the second connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 2 })
+}
+
+func TestSystemEventStalled(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	cfg.MaxIdle = 100 * time.Millisecond
+	l := sl.New(cfg)
+
+	if err := l.ListenAll(context.Background()); !errors.Is(err, sl.ErrIdleTimeout) {
+		t.Fatalf("ListenAll = %v, want ErrIdleTimeout", err)
+	}
+	stalled := rec.system(sl.SystemEventStalled)
+	if len(stalled) != 1 {
+		t.Fatalf("got %d stalled events, want 1", len(stalled))
+	}
+	if idle, _ := stalled[0]["idle"].(time.Duration); idle < cfg.MaxIdle {
+		t.Errorf("idle = %v, want at least %v", stalled[0]["idle"], cfg.MaxIdle)
+	}
+	if kinds := rec.system(sl.SystemEventDisconnected); len(kinds) != 1 {
+		t.Errorf("got %d disconnected events after stalling, want 1", len(kinds))
+	}
+}
+
+func TestRepeatedServiceRestartBacksOff(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	for i := 1; i <= 2; i++ {
+		waitFor(t, "a connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == i })
+		srv.Disconnect(ws.CloseServiceRestart, "restart")
+		waitFor(t, "a reconnecting event", func() bool { return len(rec.system(sl.SystemEventReconnecting)) == i })
+	}
+
+	events := rec.system(sl.SystemEventReconnecting)
+	if wait := events[0]["wait"].(time.Duration); wait != 0 {
+		t.Errorf("first restart waited %v, want 0", wait)
+	}
+	// The second consecutive restart counts as a second failure: the
+	// reconnect_delay of 1s doubled, jittered down by up to half.
+	if attempt, wait := events[1]["attempt"], events[1]["wait"].(time.Duration); attempt != 2 || wait < time.Second {
+		t.Errorf("second restart: attempt %v, wait %v; want attempt 2 and at least 1s", attempt, wait)
+	}
+}
+
+func TestCertificateErrorsAreNotRetried(t *testing.T) {
+	// The client does not trust the test server's certificate.
+	tlsSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsSrv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg := sl.Config{
+		APIKey:             "sk_test_mock",
+		APIBaseURL:         tlsSrv.URL,
+		Handler:            &recorder{},
+		AuthorizeRetries:   3,
+		AuthorizeRetryWait: time.Minute,
+		ConnectRetries:     3,
+	}
+
+	t.Run("authorize", func(t *testing.T) {
+		l := sl.New(cfg)
+		_, err := l.Authorize(ctx)
+		if err == nil || ctx.Err() != nil || !strings.Contains(err.Error(), "certificate") {
+			t.Fatalf("Authorize = %v, want a certificate error without retries", err)
+		}
+	})
+	t.Run("dial", func(t *testing.T) {
+		l := sl.New(cfg)
+		err := l.SetSession(&sl.Session{
+			ReconnectDelay:             60,
+			WebSocketAuthorizedFeature: sl.FeatureWebhooks,
+			WebSocketID:                "mock_ws_1",
+			WebSocketURL:               "wss" + strings.TrimPrefix(tlsSrv.URL, "https") + "/ws",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Connect(ctx); err == nil || ctx.Err() != nil || !strings.Contains(err.Error(), "certificate") {
+			t.Fatalf("Connect = %v, want a certificate error without retries", err)
+		}
+	})
+}
+
+func TestHealthyResetsOnConnect(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	cfg.Handler = &recorder{}
+	cfg.PingPeriod = 50 * time.Millisecond
+	l := sl.New(cfg)
+	ctx := context.Background()
+	if _, err := l.Authorize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- l.Listen(ctx) }()
+	waitFor(t, "a pong", l.Healthy)
+	l.Close()
+	<-done
+
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Healthy() {
+		t.Error("Healthy before the new connection's first pong")
+	}
+	if !l.LastPong().IsZero() {
+		t.Errorf("LastPong = %v before the new connection's first pong", l.LastPong())
+	}
+}
+
+func TestForwardEndsWithListen(t *testing.T) {
+	arrived, cancelled := make(chan struct{}), make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body
+		// has been read.
+		io.Copy(io.Discard, r.Body)
+		close(arrived)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer local.Close()
+	defer local.CloseClientConnections()
+
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	cfg.Handler = &recorder{}
+	cfg.ForwardTo = local.URL
+	l := sl.New(cfg)
+	stop := listen(t, l)
+
+	pushEvents(srv, 1)
+	<-arrived
+	stop()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward request not cancelled when Listen returned")
+	}
+	for _, f := range srv.Received() {
+		if strings.Contains(string(f), sl.MsgTypeWebhookResponse) {
+			t.Errorf("webhook_response sent after Listen returned: %s", f)
+		}
+	}
+}
+
+// logRecorder is a Logger that keeps the warnings it is given.
+type logRecorder struct {
+	mu    sync.Mutex
+	warns []string
+}
+
+func (*logRecorder) Debugf(string, ...interface{}) {}
+func (*logRecorder) Infof(string, ...interface{})  {}
+func (*logRecorder) Errorf(string, ...interface{}) {}
+
+func (r *logRecorder) Warnf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warns = append(r.warns, fmt.Sprintf(format, args...))
+}
+
+func (r *logRecorder) warned(substr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, w := range r.warns {
+		if strings.Contains(w, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBackoffWarnsOnZeroReconnectDelay(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	srv.SetReconnectDelay(0)
+	rec := &systemRecorder{}
+	logs := &logRecorder{}
+	cfg.Handler = rec
+	cfg.Logger = logs
+	cfg.DeliverLifecycleEvents = true
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	waitFor(t, "the first connection", func() bool { return srv.OpenConnections() == 1 })
+	srv.Disconnect(ws.CloseGoingAway, "bye")
+	waitFor(t, "a reconnecting event", func() bool { return len(rec.system(sl.SystemEventReconnecting)) == 1 })
+
+	if !logs.warned("reconnect_delay is 0") {
+		t.Errorf("no warning about the zero reconnect_delay; got %q", logs.warns)
+	}
+	if wait := rec.system(sl.SystemEventReconnecting)[0]["wait"].(time.Duration); wait < sl.DefaultReconnectWait/2 {
+		t.Errorf("wait = %v, want at least half of DefaultReconnectWait", wait)
+	}
+}
+
+func TestFeatureThinEvents(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &recorder{}
+	cfg.Handler = rec
+	cfg.WebSocketFeatures = []string{sl.FeatureThinEvents}
+	l := sl.New(cfg)
+	stop := listen(t, l)
+	defer stop()
+
+	srv.Push(testutil.V2EventFrame(`{"id":"evt_thin","object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":false,"created":"2024-09-17T06:20:52.246Z"}`))
+	waitFor(t, "the thin event to be handled", func() bool {
+		_, v2 := rec.handled()
+		return len(v2) == 1
+	})
+	if f := l.Session().WebSocketAuthorizedFeature; f != sl.FeatureWebhooks {
+		t.Errorf("authorized feature %q, want %q", f, sl.FeatureWebhooks)
+	}
+}
+
+// accountRecorder records the Connect account of each event handled.
+type accountRecorder struct {
+	recorder
+	accounts []string
+}
+
+func (r *accountRecorder) OnWebhookEvent(_ sl.WebhookEvent, p sl.StripeEventPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v1 = append(r.v1, p.ID)
+	r.accounts = append(r.accounts, p.Account)
+}
+
+func TestAccountFiltering(t *testing.T) {
+	// One event per account, in this order; "" is the platform account.
+	accounts := []string{"acct_a", "acct_b", "", "acct_c"}
+	tests := []struct {
+		name     string
+		allow    []string
+		filter   func(string) bool
+		expected []string
+	}{
+		{"all", nil, nil, accounts},
+		{"allowlist", []string{"acct_a", "acct_c"}, nil, []string{"acct_a", "acct_c"}},
+		{"allowlist with platform", []string{"", "acct_b"}, nil, []string{"acct_b", ""}},
+		{"filter", nil, func(a string) bool { return a != "acct_b" }, []string{"acct_a", "", "acct_c"}},
+		{"both", []string{"acct_a", "acct_b"}, func(a string) bool { return a != "acct_b" }, []string{"acct_a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			rec := &accountRecorder{}
+			cfg.Handler = rec
+			cfg.Accounts = tt.allow
+			cfg.AccountFilter = tt.filter
+			l := sl.New(cfg)
+			stop := listen(t, l)
+			defer stop()
+
+			for i, acct := range accounts {
+				id := fmt.Sprintf("evt_%d", i)
+				srv.Push(testutil.WebhookEventFrame(id, fmt.Sprintf(`{"id":%q,"object":"event","type":"customer.created","account":%q,"created":1726554052,"data":{"object":{"id":"cus_%d","object":"customer"}}}`, id, acct, i)))
+			}
+			// Filtered-out events are ACKed too.
+			waitFor(t, "every event to be ACKed", func() bool { return len(acked(srv)) == len(accounts) })
+			stop()
+
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if fmt.Sprintf("%q", rec.accounts) != fmt.Sprintf("%q", tt.expected) {
+				t.Errorf("handled accounts %q, want %q", rec.accounts, tt.expected)
+			}
+		})
+	}
+}
+
+// slowACKer is a WebhookACKHandler whose handlers take the time listed for
+// their event ID, so that they finish out of order.
+type slowACKer struct {
+	recorder
+	delays map[string]time.Duration
+}
+
+func (r *slowACKer) HandleWebhookEvent(_ context.Context, evt sl.WebhookEvent, p sl.StripeEventPayload) error {
+	time.Sleep(r.delays[p.ID])
+	r.OnWebhookEvent(evt, p)
+	return nil
+}
+
+func TestOrderedACKs(t *testing.T) {
+	tests := []struct {
+		name string
+		wait time.Duration // OrderedACKWait
+		want []string
+	}{
+		{"in order", 0, []string{"evt_0", "evt_1", "evt_2"}},
+		// evt_0's handler outlasts the wait, so the others go first.
+		{"bounded", 100 * time.Millisecond, []string{"evt_2", "evt_1", "evt_0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			rec := &slowACKer{delays: map[string]time.Duration{
+				"evt_0": 600 * time.Millisecond,
+				"evt_1": 300 * time.Millisecond,
+			}}
+			cfg.Handler = rec
+			cfg.Concurrency = 3
+			cfg.OrderedACKs = true
+			cfg.OrderedACKWait = tt.wait
+			l := sl.New(cfg)
+			stop := listen(t, l)
+			defer stop()
+
+			pushEvents(srv, 3)
+			waitFor(t, "three ACKs", func() bool { return len(acked(srv)) == 3 })
+			if handled, _ := rec.handled(); fmt.Sprint(handled) != "[evt_2 evt_1 evt_0]" {
+				t.Fatalf("handlers finished in order %v, want evt_2 first", handled)
+			}
+			if got := acked(srv); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("ACKed in order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconnectReuseSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		expire   bool
+		sessions int // created by the time the second connection is up
+	}{
+		{"reused", false, 1},
+		{"expired", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := testutil.NewMockServer()
+			defer srv.Close()
+			rec := &systemRecorder{}
+			cfg.Handler = rec
+			cfg.DeliverLifecycleEvents = true
+			cfg.ReconnectReuseSession = true
+			l := sl.New(cfg)
+			stop := listenWithReconnect(t, l)
+			defer stop()
+
+			waitFor(t, "the first connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 1 })
+			if tt.expire {
+				srv.ExpireSessions()
+			}
+			srv.Disconnect(ws.CloseGoingAway, "bye")
+			waitFor(t, "the second connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 2 })
+			if n := srv.Sessions(); n != tt.sessions {
+				t.Errorf("%d sessions created, want %d", n, tt.sessions)
+			}
+			// Only the one disconnect backed off.
+			if n := len(rec.system(sl.SystemEventReconnecting)); n != 1 {
+				t.Errorf("%d reconnecting events, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWarmSpareSession(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	cfg.WarmSpareSession = true
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	waitFor(t, "the spare session", func() bool {
+		return len(rec.system(sl.SystemEventConnected)) == 1 && srv.Sessions() == 2
+	})
+	first := l.Session().WebSocketID
+	srv.Disconnect(ws.CloseGoingAway, "bye")
+	waitFor(t, "the second connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 2 })
+	if got := rec.system(sl.SystemEventReconnecting); len(got) != 1 || got[0]["wait"] != time.Duration(0) {
+		t.Errorf("reconnecting events %v, want one without a wait", got)
+	}
+	if s := l.Session(); s == nil || s.WebSocketID == first {
+		t.Errorf("reconnected with session %+v, want the spare", s)
+	}
+	waitFor(t, "a new spare session", func() bool { return srv.Sessions() == 3 })
+}
+
+func TestReconnect(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	l := sl.New(cfg)
+	if err := l.Reconnect(); !errors.Is(err, sl.ErrNotReconnecting) {
+		t.Fatalf("Reconnect without a running loop = %v, want ErrNotReconnecting", err)
+	}
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	waitFor(t, "the first connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 1 })
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Reconnect(); err != nil {
+				t.Errorf("Reconnect: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the second connection", func() bool { return len(rec.system(sl.SystemEventConnected)) == 2 })
+	if d := rec.system(sl.SystemEventDisconnected)[0]; d["error"] != sl.ErrSessionRefresh.Error() {
+		t.Errorf("first connection ended with %v, want a session refresh", d["error"])
+	}
+	if n := len(rec.system(sl.SystemEventReconnecting)); n != 0 {
+		t.Errorf("%d reconnecting events; a manual reconnect must not back off", n)
+	}
+	if n := srv.Sessions(); n != 2 {
+		t.Errorf("%d sessions created, want 2: concurrent calls must merge", n)
+	}
+	pushEvents(srv, 1)
+	waitFor(t, "an event on the new connection", func() bool {
+		handled, _ := rec.handled()
+		return len(handled) == 1
+	})
+}
+
+func TestMaxEventsPerConnection(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &systemRecorder{}
+	cfg.Handler = rec
+	cfg.DeliverLifecycleEvents = true
+	cfg.MaxEventsPerConnection = 2
+	l := sl.New(cfg)
+	stop := listenWithReconnect(t, l)
+	defer stop()
+
+	ids := pushEvents(srv, 3)
+	waitFor(t, "the rotation", func() bool { return len(rec.system(sl.SystemEventConnected)) == 2 })
+	if d := rec.system(sl.SystemEventDisconnected)[0]; d["error"] != sl.ErrSessionRefresh.Error() {
+		t.Errorf("first connection ended with %v, want a session refresh", d["error"])
+	}
+	if n := len(rec.system(sl.SystemEventReconnecting)); n != 0 {
+		t.Errorf("%d reconnecting events; a rotation must not back off", n)
+	}
+
+	// The count restarts on the new connection: two more events rotate it
+	// again.
+	ids = append(ids, "evt_3", "evt_4")
+	pushEvents(srv, 5)
+	waitFor(t, "the second rotation", func() bool { return len(rec.system(sl.SystemEventConnected)) == 3 })
+	waitFor(t, "every event to be handled", func() bool {
+		handled, _ := rec.handled()
+		return len(handled) >= len(ids)
+	})
+	// The redelivered evt_0..evt_2 are dropped as duplicates.
+	if handled, _ := rec.handled(); fmt.Sprint(handled) != fmt.Sprint(ids) {
+		t.Errorf("handled %v, want %v", handled, ids)
+	}
+}
+
+// deadlineRecorder records, per event type, how long handlers had left
+// before their ctx deadline, or -1 without one.
+type deadlineRecorder struct {
+	mu   sync.Mutex
+	left map[string]time.Duration
+}
+
+func (r *deadlineRecorder) record(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	left := time.Duration(-1)
+	if d, ok := ctx.Deadline(); ok {
+		left = time.Until(d)
+	}
+	r.left[sl.EventTypeFromContext(ctx)] = left
+}
+
+func (r *deadlineRecorder) OnWebhookEvent(ctx context.Context, _ sl.WebhookEvent, _ sl.StripeEventPayload) {
+	r.record(ctx)
+}
+
+func (r *deadlineRecorder) OnV2Event(ctx context.Context, _ sl.V2Event, _ sl.V2EventPayload) {
+	r.record(ctx)
+}
+
+func (*deadlineRecorder) OnUnknownMessage(context.Context, string, json.RawMessage) {}
+
+func TestHandlerTimeouts(t *testing.T) {
+	srv, cfg := testutil.NewMockServer()
+	defer srv.Close()
+	rec := &deadlineRecorder{left: map[string]time.Duration{}}
+	cfg.HandlerContext = rec
+	cfg.HandlerTimeout = time.Hour
+	cfg.HandlerTimeouts = map[string]time.Duration{
+		"customer.created": time.Minute,
+		"customer.*":       2 * time.Minute,
+		"*.updated":        3 * time.Minute,
+		"charge.*":         0,
+		"v1.billing.*":     4 * time.Minute,
+	}
+	l := sl.New(cfg)
+	stop := listen(t, l)
+	defer stop()
+
+	want := map[string]time.Duration{
+		"customer.created":                time.Minute,     // exact key over patterns
+		"customer.updated":                2 * time.Minute, // longest pattern
+		"invoice.paid":                    time.Hour,       // HandlerTimeout
+		"charge.refunded":                 -1,              // no deadline
+		"v1.billing.meter.no_meter_found": 4 * time.Minute, // v2 events too
+	}
+	for i, typ := range []string{"customer.created", "customer.updated", "invoice.paid", "charge.refunded"} {
+		id := fmt.Sprintf("evt_%d", i)
+		srv.Push(testutil.WebhookEventFrame(id, fmt.Sprintf(`{"id":%q,"object":"event","type":%q,"created":1726554052,"data":{"object":{"id":"obj_%d"}}}`, id, typ, i)))
+	}
+	srv.Push(testutil.V2EventFrame(`{"id":"evt_v2","object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":false,"created":"2024-09-17T06:20:52.246Z"}`))
+	waitFor(t, "every event", func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.left) == len(want)
+	})
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for typ, w := range want {
+		got := rec.left[typ]
+		if w < 0 && got != -1 || w > 0 && (got > w || got < w-10*time.Second) {
+			t.Errorf("%s: %s left, want %s", typ, got, w)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package stripelistener
+
+import "time"
+
+// ---------------------------------------------------------------------------
+// Metrics – optional instrumentation hooks
+// ---------------------------------------------------------------------------
+
+// Metrics receives counters and timings from the listener, e.g. to back
+// Prometheus collectors (see example/metrics.go). Methods are called from
+// the read loop and worker goroutines and must be safe for concurrent use
+// and fast.
+type Metrics interface {
+	// IncEvent is called for every v1 or v2 event received.
+	IncEvent(eventType string)
+
+	// ObserveHandlerDuration is called after every handler invocation.
+	ObserveHandlerDuration(d time.Duration)
+
+	// IncReconnect is called for every ListenWithReconnect retry.
+	IncReconnect()
+
+	// IncACKFailure is called when an ACK could not be sent.
+	IncACKFailure()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncEvent(string)                      {}
+func (nopMetrics) ObserveHandlerDuration(time.Duration) {}
+func (nopMetrics) IncReconnect()                        {}
+func (nopMetrics) IncACKFailure()                       {}
@@ -0,0 +1,95 @@
+package stripelistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Mux – route v1 webhook events to handlers by event type
+// ---------------------------------------------------------------------------
+
+// Mux is an EventHandler that routes v1 webhook events to the functions
+// registered for their type:
+//
+//	m := stripelistener.NewMux()
+//	m.On("payment_intent.succeeded", onPaymentSucceeded)
+//	m.On("customer.*", onCustomer)
+//	cfg.Handler = m
+//
+// Every matching function runs, in registration order. Because Mux also
+// implements WebhookACKHandler, an event is ACKed only if all of them
+// return nil; otherwise it is left un-ACKed for Stripe to redeliver, and
+// every matching function runs again on redelivery. v2 events and unknown
+// messages are ignored.
+//
+// A Mux is safe for concurrent use, and On may be called while listening.
+type Mux struct {
+	mu       sync.RWMutex
+	routes   []muxRoute
+	fallback func(StripeEventPayload) error
+}
+
+type muxRoute struct {
+	pattern string
+	fn      func(StripeEventPayload) error
+}
+
+// NewMux returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// On registers fn for events whose type matches pattern. A pattern is an
+// exact type ("charge.refunded"), a prefix ending in '*'
+// ("payment_intent.*"), a suffix starting with '*' ("*.deleted"), or "*"
+// for every event, as in Config.EventTypes.
+func (m *Mux) On(pattern string, fn func(StripeEventPayload) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes = append(m.routes, muxRoute{pattern: pattern, fn: fn})
+}
+
+// Fallback sets fn to receive events that match no pattern registered with
+// On. Without a fallback such events are ACKed and dropped.
+func (m *Mux) Fallback(fn func(StripeEventPayload) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fallback = fn
+}
+
+// HandleWebhookEvent runs the functions matching parsed.Type and returns
+// their errors joined together.
+func (m *Mux) HandleWebhookEvent(_ context.Context, _ WebhookEvent, parsed StripeEventPayload) error {
+	m.mu.RLock()
+	var fns []func(StripeEventPayload) error
+	for _, r := range m.routes {
+		if matchType(r.pattern, parsed.Type) {
+			fns = append(fns, r.fn)
+		}
+	}
+	if len(fns) == 0 && m.fallback != nil {
+		fns = append(fns, m.fallback)
+	}
+	m.mu.RUnlock()
+
+	var errs []error
+	for _, fn := range fns {
+		if err := fn(parsed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OnWebhookEvent runs the matching functions and discards their errors. The
+// listener calls HandleWebhookEvent instead; OnWebhookEvent is there for
+// callers that wrap the Mux in their own EventHandler.
+func (m *Mux) OnWebhookEvent(evt WebhookEvent, parsed StripeEventPayload) {
+	_ = m.HandleWebhookEvent(context.Background(), evt, parsed)
+}
+
+func (*Mux) OnV2Event(V2Event, V2EventPayload)        {}
+func (*Mux) OnUnknownMessage(string, json.RawMessage) {}
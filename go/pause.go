@@ -0,0 +1,31 @@
+package stripelistener
+
+// ---------------------------------------------------------------------------
+// Pause / Resume – hold off processing without dropping the connection
+// ---------------------------------------------------------------------------
+
+// Pause stops the listener from ACKing, forwarding and dispatching events
+// until Resume is called, e.g. while a downstream service is redeployed.
+// Stripe redelivers the events received in the meantime.
+//
+// The connection stays open and is still read: pings, pongs and close
+// frames are only handled while reading, so not reading would let the
+// keepalive, and possibly Stripe, drop the connection. Handlers already
+// running or queued are not interrupted. Safe to call from any goroutine.
+func (l *Listener) Pause() {
+	if !l.paused.Swap(true) {
+		l.cfg.Logger.Infof("paused; events will be left un-ACKed")
+	}
+}
+
+// Resume undoes Pause.
+func (l *Listener) Resume() {
+	if l.paused.Swap(false) {
+		l.cfg.Logger.Infof("resumed")
+	}
+}
+
+// Paused reports whether the listener is paused.
+func (l *Listener) Paused() bool {
+	return l.paused.Load()
+}
@@ -0,0 +1,141 @@
+package stripelistener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// StripeEventPayload helpers
+// ---------------------------------------------------------------------------
+
+// MarshalCanonical returns a stable JSON encoding of the parsed payload with
+// object keys sorted at every level and no insignificant whitespace. It is
+// meant for deterministic logging, diffing and hashing.
+//
+// The output only contains the fields StripeEventPayload knows about and
+// differs byte-for-byte from WebhookEvent.EventPayload, so it must never be
+// used to verify the Stripe-Signature of the original delivery.
+func (p StripeEventPayload) MarshalCanonical() ([]byte, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round-trip through a generic value: encoding/json sorts map keys,
+	// and UseNumber keeps numbers exactly as they were encoded.
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// DataObject decodes data.object into v, which can be any type
+// encoding/json can decode into: your own struct, or a stripe-go type such
+// as *stripe.PaymentIntent. Decoding works from the original bytes, so
+// numbers and nested objects keep their full fidelity.
+func (p StripeEventPayload) DataObject(v interface{}) error {
+	return p.decodeData("object", v)
+}
+
+// DataPreviousAttributes decodes data.previous_attributes into v. Only
+// *.updated events carry it.
+func (p StripeEventPayload) DataPreviousAttributes(v interface{}) error {
+	return p.decodeData("previous_attributes", v)
+}
+
+func (p StripeEventPayload) decodeData(field string, v interface{}) error {
+	raw := p.rawData
+	if raw == nil {
+		// Payload built in code rather than parsed; fall back to Data.
+		var err error
+		if raw, err = json.Marshal(p.Data); err != nil {
+			return err
+		}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return fmt.Errorf("decode data: %w", err)
+	}
+	inner, ok := fields[field]
+	if !ok || string(inner) == "null" {
+		return fmt.Errorf("event %s has no data.%s", p.ID, field)
+	}
+	return json.Unmarshal(inner, v)
+}
+
+// IsDeletion reports whether the event describes a deleted object, either
+// because its type ends in ".deleted" or because data.object carries
+// "deleted": true.
+func (p StripeEventPayload) IsDeletion() bool {
+	if strings.HasSuffix(p.Type, ".deleted") {
+		return true
+	}
+	deleted, _ := p.Object()["deleted"].(bool)
+	return deleted
+}
+
+// DeletedObjectID returns the id of the deleted object, or "" if the event
+// is not a deletion.
+func (p StripeEventPayload) DeletedObjectID() string {
+	if !p.IsDeletion() {
+		return ""
+	}
+	id, _ := p.Object()["id"].(string)
+	return id
+}
+
+// Object returns data.object as a map, or nil. Use DataObject to decode it
+// into a typed value instead.
+func (p StripeEventPayload) Object() map[string]interface{} {
+	obj, _ := p.Data["object"].(map[string]interface{})
+	return obj
+}
+
+// PreviousAttributes returns data.previous_attributes as a map: the fields
+// of Object that changed, with their values before the change. It is nil
+// for events other than *.updated.
+func (p StripeEventPayload) PreviousAttributes() map[string]interface{} {
+	prev, _ := p.Data["previous_attributes"].(map[string]interface{})
+	return prev
+}
+
+// FieldChange is the before and after value of one field of an updated
+// object.
+type FieldChange struct {
+	Old interface{}
+	New interface{}
+}
+
+// ChangedFields returns, for *.updated events, every top-level key in
+// data.previous_attributes with its old value and its current value from
+// data.object. It returns nil when the event has no previous_attributes.
+//
+// Changes are reported per top-level key only. For a nested object such as
+// metadata, Old holds just the nested keys Stripe reported as changed while
+// New holds the whole current object.
+func (p StripeEventPayload) ChangedFields() map[string]FieldChange {
+	prev := p.PreviousAttributes()
+	if len(prev) == 0 {
+		return nil
+	}
+	obj := p.Object()
+	changes := make(map[string]FieldChange, len(prev))
+	for k, old := range prev {
+		changes[k] = FieldChange{Old: old, New: obj[k]}
+	}
+	return changes
+}
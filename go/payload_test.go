@@ -0,0 +1,355 @@
+package stripelistener_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	sl "github.com/kmoz000/stripelistener/go"
+)
+
+// v2MeterEvent is a v2 thin event as Stripe sends it.
+const v2MeterEvent = `{
+  "id": "evt_test_65R9Ijk8cZ2Pw1ZZQmb16RfKxTSQ4",
+  "object": "v2.core.event",
+  "type": "v1.billing.meter.error_report_triggered",
+  "livemode": false,
+  "created": "2024-09-17T06:20:52.246Z",
+  "context": "acct_1Nv0FGQ9RKHgCVdK",
+  "related_object": {
+    "id": "mtr_test_61R9IjGSpKIrMvT6Q41GPCGd8AHiEI",
+    "type": "billing.meter",
+    "url": "/v1/billing/meters/mtr_test_61R9IjGSpKIrMvT6Q41GPCGd8AHiEI"
+  },
+  "reason": {
+    "type": "request",
+    "request": {"id": "req_v24sCESLe7mPKW", "idempotency_key": "a2f6a6ba-5c0e-4b2b-9d0b-5bd7c1fa0d0e"}
+  }
+}`
+
+func TestV2EventPayloadCreatedAndLivemode(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		created  time.Time
+		livemode bool
+	}{
+		{
+			name:    "test mode, UTC with milliseconds",
+			payload: v2MeterEvent,
+			created: time.Date(2024, 9, 17, 6, 20, 52, 246e6, time.UTC),
+		},
+		{
+			name:     "live mode, numeric offset",
+			payload:  `{"id":"evt_1","type":"v1.billing.meter.no_meter_found","livemode":true,"created":"2024-09-17T08:20:52+02:00"}`,
+			created:  time.Date(2024, 9, 17, 6, 20, 52, 0, time.UTC),
+			livemode: true,
+		},
+		{
+			name:    "no created",
+			payload: `{"id":"evt_2","type":"v1.billing.meter.no_meter_found"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p sl.V2EventPayload
+			if err := json.Unmarshal([]byte(tt.payload), &p); err != nil {
+				t.Fatal(err)
+			}
+			if !p.Created.Equal(tt.created) {
+				t.Errorf("Created = %v, want %v", p.Created, tt.created)
+			}
+			if p.Livemode != tt.livemode {
+				t.Errorf("Livemode = %t, want %t", p.Livemode, tt.livemode)
+			}
+		})
+	}
+}
+
+func TestLatencyV1AndV2(t *testing.T) {
+	received := time.Date(2024, 9, 17, 6, 20, 55, 0, time.UTC)
+
+	var v1 sl.StripeEventPayload
+	if err := json.Unmarshal([]byte(`{"id":"evt_1","type":"customer.created","created":1726554052,"data":{"object":{}}}`), &v1); err != nil {
+		t.Fatal(err)
+	}
+	if got := (sl.WebhookEvent{ReceivedAt: received}).Latency(v1); got != 3*time.Second {
+		t.Errorf("v1 Latency = %v, want 3s", got)
+	}
+
+	var v2 sl.V2EventPayload
+	if err := json.Unmarshal([]byte(v2MeterEvent), &v2); err != nil {
+		t.Fatal(err)
+	}
+	if got := (sl.V2Event{ReceivedAt: received}).Latency(v2); got != 2754*time.Millisecond {
+		t.Errorf("v2 Latency = %v, want 2.754s", got)
+	}
+}
+
+func TestIsDeletion(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		isDeleted bool
+		id        string
+	}{
+		{
+			name:      "type suffix",
+			payload:   `{"id":"evt_1","object":"event","type":"customer.deleted","created":1726554052,"livemode":false,"data":{"object":{"id":"cus_QpXyR7Q0nLcVKE","object":"customer","email":"jenny@example.com","metadata":{}}}}`,
+			isDeleted: true,
+			id:        "cus_QpXyR7Q0nLcVKE",
+		},
+		{
+			name:      "deleted flag",
+			payload:   `{"id":"evt_2","object":"event","type":"product.updated","created":1726554052,"data":{"object":{"id":"prod_QpY1cUxAqFJ8Vb","object":"product","deleted":true}}}`,
+			isDeleted: true,
+			id:        "prod_QpY1cUxAqFJ8Vb",
+		},
+		{
+			name:    "deleted false",
+			payload: `{"id":"evt_3","object":"event","type":"product.updated","created":1726554052,"data":{"object":{"id":"prod_QpY1cUxAqFJ8Vb","object":"product","deleted":false}}}`,
+		},
+		{
+			name:    "not a deletion",
+			payload: `{"id":"evt_4","object":"event","type":"customer.created","created":1726554052,"data":{"object":{"id":"cus_QpXyR7Q0nLcVKE","object":"customer"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p sl.StripeEventPayload
+			if err := json.Unmarshal([]byte(tt.payload), &p); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.IsDeletion(); got != tt.isDeleted {
+				t.Errorf("IsDeletion() = %t, want %t", got, tt.isDeleted)
+			}
+			if got := p.DeletedObjectID(); got != tt.id {
+				t.Errorf("DeletedObjectID() = %q, want %q", got, tt.id)
+			}
+		})
+	}
+}
+
+// customerUpdated is a customer.updated event whose email and one metadata
+// key changed.
+const customerUpdated = `{
+  "id": "evt_1PyQ3s2eZvKYlo2CmX0wB3Tq",
+  "object": "event",
+  "api_version": "2024-06-20",
+  "created": 1726554052,
+  "type": "customer.updated",
+  "livemode": false,
+  "pending_webhooks": 1,
+  "data": {
+    "object": {
+      "id": "cus_QpXyR7Q0nLcVKE",
+      "object": "customer",
+      "balance": 0,
+      "email": "jenny.rosen@example.com",
+      "metadata": {"plan": "pro", "region": "eu"},
+      "name": "Jenny Rosen"
+    },
+    "previous_attributes": {
+      "email": "jenny@example.com",
+      "metadata": {"plan": "basic"}
+    }
+  }
+}`
+
+func TestChangedFields(t *testing.T) {
+	var p sl.StripeEventPayload
+	if err := json.Unmarshal([]byte(customerUpdated), &p); err != nil {
+		t.Fatal(err)
+	}
+	changes := p.ChangedFields()
+
+	tests := []struct {
+		field string
+		old   string
+		new   string
+	}{
+		{"email", `"jenny@example.com"`, `"jenny.rosen@example.com"`},
+		// Nested objects: Old holds only the changed keys, New the whole object.
+		{"metadata", `{"plan":"basic"}`, `{"plan":"pro","region":"eu"}`},
+	}
+	if len(changes) != len(tests) {
+		t.Fatalf("ChangedFields() = %v, want %d fields", changes, len(tests))
+	}
+	for _, tt := range tests {
+		c, ok := changes[tt.field]
+		if !ok {
+			t.Errorf("%s missing from ChangedFields()", tt.field)
+			continue
+		}
+		if got := mustJSON(t, c.Old); got != tt.old {
+			t.Errorf("%s: Old = %s, want %s", tt.field, got, tt.old)
+		}
+		if got := mustJSON(t, c.New); got != tt.new {
+			t.Errorf("%s: New = %s, want %s", tt.field, got, tt.new)
+		}
+	}
+
+	var created sl.StripeEventPayload
+	if err := json.Unmarshal([]byte(`{"id":"evt_1","type":"customer.created","data":{"object":{"id":"cus_1"}}}`), &created); err != nil {
+		t.Fatal(err)
+	}
+	if got := created.ChangedFields(); got != nil {
+		t.Errorf("ChangedFields() without previous_attributes = %v, want nil", got)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDataObject(t *testing.T) {
+	const succeeded = `{
+  "id": "evt_3PyQ5b2eZvKYlo2C0k1Zr2hd",
+  "object": "event",
+  "api_version": "2024-06-20",
+  "created": 1726554163,
+  "type": "payment_intent.succeeded",
+  "data": {
+    "object": {
+      "id": "pi_3PyQ5b2eZvKYlo2C0ZcE9Y1T",
+      "object": "payment_intent",
+      "amount": 9007199254740993,
+      "currency": "eur",
+      "status": "succeeded",
+      "shipping": {
+        "name": "Jenny Rosen",
+        "address": {"city": "Berlin", "country": "DE", "postal_code": "10115"}
+      }
+    }
+  }
+}`
+	type address struct {
+		City       string `json:"city"`
+		Country    string `json:"country"`
+		PostalCode string `json:"postal_code"`
+	}
+	type paymentIntent struct {
+		ID       string `json:"id"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Shipping struct {
+			Name    string  `json:"name"`
+			Address address `json:"address"`
+		} `json:"shipping"`
+	}
+
+	var p sl.StripeEventPayload
+	if err := json.Unmarshal([]byte(succeeded), &p); err != nil {
+		t.Fatal(err)
+	}
+	var pi paymentIntent
+	if err := p.DataObject(&pi); err != nil {
+		t.Fatal(err)
+	}
+	// 2^53+1 does not survive a float64, so this checks the raw bytes are used.
+	if pi.ID != "pi_3PyQ5b2eZvKYlo2C0ZcE9Y1T" || pi.Amount != 9007199254740993 || pi.Currency != "eur" {
+		t.Errorf("DataObject = %+v", pi)
+	}
+	if want := (address{"Berlin", "DE", "10115"}); pi.Shipping.Address != want {
+		t.Errorf("nested address = %+v, want %+v", pi.Shipping.Address, want)
+	}
+	if err := p.DataPreviousAttributes(&struct{}{}); err == nil {
+		t.Error("DataPreviousAttributes on a non-update event returned no error")
+	}
+}
+
+func TestDataPreviousAttributes(t *testing.T) {
+	type customer struct {
+		Email    string            `json:"email"`
+		Metadata map[string]string `json:"metadata"`
+	}
+
+	var p sl.StripeEventPayload
+	if err := json.Unmarshal([]byte(customerUpdated), &p); err != nil {
+		t.Fatal(err)
+	}
+	var cur, prev customer
+	if err := p.DataObject(&cur); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DataPreviousAttributes(&prev); err != nil {
+		t.Fatal(err)
+	}
+	if cur.Email != "jenny.rosen@example.com" || cur.Metadata["plan"] != "pro" {
+		t.Errorf("DataObject = %+v", cur)
+	}
+	if prev.Email != "jenny@example.com" || prev.Metadata["plan"] != "basic" || len(prev.Metadata) != 1 {
+		t.Errorf("DataPreviousAttributes = %+v", prev)
+	}
+
+	// A payload built in code has no raw bytes and falls back to Data.
+	built := sl.StripeEventPayload{ID: "evt_1", Data: map[string]interface{}{
+		"object": map[string]interface{}{"email": "a@example.com"},
+	}}
+	if err := built.DataObject(&cur); err != nil || cur.Email != "a@example.com" {
+		t.Errorf("DataObject on a built payload = %+v, %v", cur, err)
+	}
+}
+
+func TestV2EventPayloadFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    sl.V2EventPayload
+	}{
+		{
+			name:    "connected account with related object",
+			payload: v2MeterEvent,
+			want: sl.V2EventPayload{
+				ID:      "evt_test_65R9Ijk8cZ2Pw1ZZQmb16RfKxTSQ4",
+				Type:    "v1.billing.meter.error_report_triggered",
+				Created: time.Date(2024, 9, 17, 6, 20, 52, 246e6, time.UTC),
+				Context: "acct_1Nv0FGQ9RKHgCVdK",
+				RelatedObject: &sl.V2RelatedObject{
+					ID:   "mtr_test_61R9IjGSpKIrMvT6Q41GPCGd8AHiEI",
+					Type: "billing.meter",
+					URL:  "/v1/billing/meters/mtr_test_61R9IjGSpKIrMvT6Q41GPCGd8AHiEI",
+				},
+			},
+		},
+		{
+			name:    "platform event without related object",
+			payload: `{"id":"evt_test_65R9J2","object":"v2.core.event","type":"v1.billing.meter.no_meter_found","livemode":true,"created":"2024-09-17T06:25:00Z","reason":null}`,
+			want: sl.V2EventPayload{
+				ID:       "evt_test_65R9J2",
+				Type:     "v1.billing.meter.no_meter_found",
+				Created:  time.Date(2024, 9, 17, 6, 25, 0, 0, time.UTC),
+				Livemode: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got sl.V2EventPayload
+			if err := json.Unmarshal([]byte(tt.payload), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.want.ID || got.Type != tt.want.Type || got.Livemode != tt.want.Livemode || got.Context != tt.want.Context {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !got.Created.Equal(tt.want.Created) {
+				t.Errorf("Created = %v, want %v", got.Created, tt.want.Created)
+			}
+			switch {
+			case tt.want.RelatedObject == nil:
+				if got.RelatedObject != nil {
+					t.Errorf("RelatedObject = %+v, want nil", *got.RelatedObject)
+				}
+			case got.RelatedObject == nil:
+				t.Errorf("RelatedObject = nil, want %+v", *tt.want.RelatedObject)
+			case *got.RelatedObject != *tt.want.RelatedObject:
+				t.Errorf("RelatedObject = %+v, want %+v", *got.RelatedObject, *tt.want.RelatedObject)
+			}
+		})
+	}
+}
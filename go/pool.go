@@ -0,0 +1,107 @@
+package stripelistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------
+// Pool – one Listener per account, fanned into a single handler
+// ---------------------------------------------------------------------------
+
+// PoolConfig configures a Pool.
+type PoolConfig struct {
+	// Accounts maps an account identifier of your choosing, such as a
+	// connected account ID or tenant name, to the Config of that account's
+	// Listener. The Configs must not set a handler of their own.
+	Accounts map[string]Config
+
+	// Handler receives the events of every account. The ctx passed to it
+	// carries the account's Config.AccountID, which defaults to its key in
+	// Accounts; see AccountIDFromContext. Handler may
+	// also implement the optional handler interfaces, such as
+	// WebhookACKHandler. It is called concurrently from several accounts.
+	Handler EventHandlerContext
+}
+
+// Pool runs one Listener per account, as set up by PoolConfig, and
+// delivers all their events to one handler.
+type Pool struct {
+	listeners map[string]*Listener
+}
+
+// NewPool creates the Listeners for cfg.Accounts. It returns an error if
+// there are no accounts, no handler, or an account Config sets a handler.
+func NewPool(cfg PoolConfig) (*Pool, error) {
+	if len(cfg.Accounts) == 0 {
+		return nil, errors.New("pool: no accounts")
+	}
+	if cfg.Handler == nil {
+		return nil, errors.New("pool: Handler is required")
+	}
+	p := &Pool{listeners: make(map[string]*Listener, len(cfg.Accounts))}
+	for account, c := range cfg.Accounts {
+		if c.Handler != nil || c.HandlerContext != nil || c.OnWebhook != nil {
+			return nil, fmt.Errorf("pool: account %q: set the handler on PoolConfig, not on the account's Config", account)
+		}
+		c.HandlerContext = cfg.Handler
+		if c.AccountID == "" {
+			c.AccountID = account
+		}
+		p.listeners[account] = New(c)
+	}
+	return p, nil
+}
+
+// Accounts returns the account identifiers of the pool, sorted.
+func (p *Pool) Accounts() []string {
+	accounts := make([]string, 0, len(p.listeners))
+	for a := range p.listeners {
+		accounts = append(accounts, a)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// Listener returns the Listener of account, or nil, e.g. to read its Stats
+// or Session.
+func (p *Pool) Listener(account string) *Listener {
+	return p.listeners[account]
+}
+
+// Run runs ListenWithReconnect for every account until ctx is cancelled.
+// An account whose listener stops on a fatal error, such as a rejected
+// key, is logged through its Logger and leaves the others running. Run
+// returns once all listeners have stopped, with their errors joined and
+// labelled by account; listeners stopped by ctx contribute ctx's error
+// only once.
+func (p *Pool) Run(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for account, l := range p.listeners {
+		wg.Add(1)
+		go func(account string, l *Listener) {
+			defer wg.Done()
+			err := l.ListenWithReconnect(ctx)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			l.cfg.Logger.Errorf("listener for account %s stopped: %v", account, err)
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("account %s: %w", account, err))
+			mu.Unlock()
+		}(account, l)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
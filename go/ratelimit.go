@@ -0,0 +1,42 @@
+package stripelistener
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// ---------------------------------------------------------------------------
+// Rate limiting – Config.RateLimit / RateBurst / RateLimitACK
+// ---------------------------------------------------------------------------
+
+// newLimiter returns the limiter for cfg, or nil when RateLimit is unset.
+func newLimiter(cfg Config) *rate.Limiter {
+	if cfg.RateLimit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.RateBurst)
+}
+
+// throttle waits until the limiter admits one more event. It returns early
+// with an error once ctx is done.
+func (l *Listener) throttle(ctx context.Context) error {
+	if l.limiter == nil {
+		return nil
+	}
+	return l.limiter.Wait(ctx)
+}
+
+// throttled wraps handle so that it waits for the limiter first, unless
+// RateLimitACK already made the read loop wait. When ctx is done before the
+// event is admitted, handle still runs: the event has usually been ACKed
+// already, so skipping it would lose it for good.
+func (l *Listener) throttled(ctx context.Context, handle func()) func() {
+	if l.limiter == nil || l.cfg.RateLimitACK {
+		return handle
+	}
+	return func() {
+		_ = l.throttle(ctx)
+		handle()
+	}
+}
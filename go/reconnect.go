@@ -0,0 +1,318 @@
+package stripelistener
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// ---------------------------------------------------------------------------
+// ListenWithReconnect – Authorize + Connect + Listen, restarted with backoff
+// ---------------------------------------------------------------------------
+
+// ListenWithReconnect runs Authorize, Connect and Listen, and starts over
+// with a fresh session whenever any of them fails or the connection drops.
+// It returns only on a fatal error: ctx being cancelled, Stop being called,
+// Authorize being rejected with HTTP 401 or 403, or the server closing the
+// connection for a policy violation (close code 1008). A close for a
+// service restart (1012) is retried straight away, without backoff; if the
+// new connection is closed for a restart again, the retries back off like
+// consecutive failures.
+//
+// With several WebSocketFeatures, each feature's connection reconnects
+// independently and the first fatal error stops all of them.
+//
+// The wait before each attempt starts at the session's reconnect_delay
+// (DefaultReconnectWait if Stripe didn't provide one), doubles on every
+// consecutive failure up to MaxReconnectWait, and is jittered down by up to
+// half so that many listeners don't retry in lockstep. The count resets
+// once a connection has been established.
+func (l *Listener) ListenWithReconnect(ctx context.Context) (err error) {
+	defer func() { l.finish(err) }()
+	if l.cfgErr != nil {
+		return l.cfgErr
+	}
+	if len(l.cfg.WebSocketFeatures) > 1 {
+		return l.listenPerFeature(ctx, (*Listener).ListenWithReconnect)
+	}
+	l.mu.Lock()
+	l.looping = true
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.looping = false
+		l.mu.Unlock()
+	}()
+
+	attempt := 0
+	restarted := false // the last connection was closed with 1012
+	reuse := false     // redial with the current session
+	var next *Session
+	var spare <-chan *Session // with WarmSpareSession; nil until warming starts
+	for {
+		if l.cfg.WarmSpareSession && spare == nil {
+			spare = l.warmSpare(ctx)
+		}
+		reusing := false
+		if next == nil && reuse {
+			next = l.Session()
+			reusing = next != nil
+		}
+		connected, stopped, refreshed, err := l.connectAndListen(ctx, next)
+		if reusing && !connected && sessionExpired(err) {
+			l.cfg.Logger.Infof("session no longer accepted (%v); authorizing a new one", err)
+			connected, stopped, refreshed, err = l.connectAndListen(ctx, nil)
+		}
+		next = nil
+		reuse = l.cfg.ReconnectReuseSession
+		if stopped {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if refreshed != nil {
+			l.cfg.Logger.Infof("session refreshed; reconnecting")
+			attempt, next, restarted = 0, refreshed, false
+			continue
+		}
+		if isFatal(err) {
+			return err
+		}
+		var ce *ConnectionClosedError
+		restart := errors.As(err, &ce) && ce.Code == ws.CloseServiceRestart
+		if connected && !(restart && restarted) {
+			attempt = 0
+		}
+		if err == nil {
+			err = errors.New("connection closed by server")
+		}
+
+		attempt++
+		l.cfg.Metrics.IncReconnect()
+		l.stats.reconnects.Add(1)
+		wait := l.backoff(attempt)
+		if restart && !restarted {
+			wait = 0
+		}
+		restarted = restart
+		if spare != nil {
+			select {
+			case s, ok := <-spare:
+				spare = nil
+				if ok {
+					l.cfg.Logger.Infof("reconnecting with the warm spare session %s", s.WebSocketID)
+					next = s
+					if connected {
+						wait = 0
+					}
+				}
+			default:
+			}
+		}
+		l.logw(levelInfo, "reconnecting", map[string]interface{}{
+			"wait":    wait.Round(time.Millisecond),
+			"attempt": attempt,
+			"error":   err,
+		})
+		l.systemEvent(SystemEventReconnecting, map[string]interface{}{
+			"attempt": attempt,
+			"wait":    wait,
+			"error":   err.Error(),
+		})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.cfg.Clock.After(wait):
+		}
+	}
+}
+
+// ErrSessionRefresh is passed to OnDisconnect when ListenWithReconnect
+// closes a connection to move to a refreshed session.
+var ErrSessionRefresh = errors.New("session refresh")
+
+// ErrNotReconnecting is returned by Reconnect when ListenWithReconnect is
+// not running.
+var ErrNotReconnecting = errors.New("ListenWithReconnect is not running")
+
+// Reconnect makes a running ListenWithReconnect move to a new connection
+// now, without waiting for the current one to fail. A new session is
+// authorized while the current connection keeps delivering events; only
+// then is the connection closed, as for a SessionRefreshInterval refresh,
+// and the new one dialed without backing off. If authorizing fails the
+// current connection is kept and the failure is logged.
+//
+// Reconnect does not block. It is safe to call concurrently: calls made
+// while a reconnect is pending, or while the loop is already between
+// connections, are merged into that reconnect. It returns
+// ErrNotReconnecting when ListenWithReconnect is not running.
+func (l *Listener) Reconnect() error {
+	l.mu.Lock()
+	children := l.children
+	looping := l.looping
+	l.mu.Unlock()
+	if len(children) > 0 {
+		var errs []error
+		for _, c := range children {
+			errs = append(errs, c.Reconnect())
+		}
+		return errors.Join(errs...)
+	}
+	if !looping {
+		return ErrNotReconnecting
+	}
+	l.cfg.Logger.Infof("manual reconnect requested")
+	l.requestRotation()
+	return nil
+}
+
+// connectAndListen performs one Authorize/Connect/Listen cycle, using sess
+// instead of authorizing when it is non-nil. If the connection ended for a
+// session refresh, refreshed holds the new session.
+func (l *Listener) connectAndListen(ctx context.Context, sess *Session) (connected, stopped bool, refreshed *Session, err error) {
+	if sess != nil {
+		l.mu.Lock()
+		l.session = sess
+		l.mu.Unlock()
+	} else if _, err := l.Authorize(ctx); err != nil {
+		return false, false, nil, err
+	}
+	if err := l.Connect(ctx); err != nil {
+		return false, false, nil, err
+	}
+
+	refresh := make(chan *Session, 1)
+	rotate := make(chan struct{}, 1)
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go l.refreshSession(rctx, refresh, rotate)
+	l.mu.Lock()
+	l.rotate = rotate
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.rotate = nil
+		l.mu.Unlock()
+	}()
+
+	stopped, err = l.listen(ctx)
+	if stopped && errors.Is(err, ErrSessionRefresh) {
+		select {
+		case s := <-refresh:
+			return true, false, s, nil
+		default:
+		}
+	}
+	return true, stopped, nil, err
+}
+
+// refreshSession creates a new session every SessionRefreshInterval, or
+// when a rotation is requested, until one succeeds, then hands it over and
+// stops the current connection.
+func (l *Listener) refreshSession(ctx context.Context, out chan<- *Session, rotate <-chan struct{}) {
+	for {
+		var tick <-chan time.Time
+		if l.cfg.SessionRefreshInterval > 0 {
+			tick = l.cfg.Clock.After(l.cfg.SessionRefreshInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-rotate:
+		}
+		s, err := l.requestSession(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				l.cfg.Logger.Warnf("session refresh failed; keeping current connection: %v", err)
+			}
+			continue
+		}
+		out <- s
+		l.Stop(ErrSessionRefresh)
+		return
+	}
+}
+
+// warmSpare authorizes a spare session in the background. The channel
+// yields it, or is closed empty if authorizing failed.
+func (l *Listener) warmSpare(ctx context.Context) <-chan *Session {
+	ch := make(chan *Session, 1)
+	go func() {
+		s, err := l.requestSession(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				l.cfg.Logger.Warnf("warming a spare session failed: %v", err)
+			}
+			close(ch)
+			return
+		}
+		ch <- s
+	}()
+	return ch
+}
+
+// requestRotation asks a running ListenWithReconnect to move to a fresh
+// session as a SessionRefreshInterval refresh would. It reports false when
+// there is no reconnect loop to ask. Requests made while one is pending
+// are merged into it.
+func (l *Listener) requestRotation() bool {
+	l.mu.Lock()
+	rotate := l.rotate
+	l.mu.Unlock()
+	if rotate == nil {
+		return false
+	}
+	select {
+	case rotate <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// backoff returns the jittered wait before the given attempt (1-based).
+func (l *Listener) backoff(attempt int) time.Duration {
+	base := DefaultReconnectWait
+	if s := l.Session(); s != nil {
+		if s.ReconnectDelay > 0 {
+			base = time.Duration(s.ReconnectDelay) * time.Second
+		} else {
+			l.cfg.Logger.Warnf("session reconnect_delay is %d; using %s instead", s.ReconnectDelay, base)
+		}
+	}
+
+	d := base
+	for i := 1; i < attempt && d < l.cfg.MaxReconnectWait; i++ {
+		d *= 2
+	}
+	if d > l.cfg.MaxReconnectWait {
+		d = l.cfg.MaxReconnectWait
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sessionExpired reports whether a dial failed because the server no longer
+// accepts the session: the handshake was refused with a 4xx response.
+func sessionExpired(err error) bool {
+	var he *HandshakeError
+	return errors.As(err, &he) && he.StatusCode >= 400 && he.StatusCode < 500
+}
+
+// isFatal reports whether err should stop ListenWithReconnect.
+func isFatal(err error) bool {
+	var se *AuthorizeError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden
+	}
+	var ce *ConnectionClosedError
+	if errors.As(err, &ce) {
+		return ce.Code == ws.ClosePolicyViolation
+	}
+	return false
+}
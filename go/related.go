@@ -0,0 +1,61 @@
+package stripelistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ---------------------------------------------------------------------------
+// FetchRelatedObject – load the object a v2 thin event refers to
+// ---------------------------------------------------------------------------
+
+// FetchRelatedObject GETs evt.RelatedObject.URL from the Stripe API with
+// the configured APIKey (or APIKeyFunc), HTTPClient and APIVersion, and
+// decodes the response into v. For events from a connected account,
+// evt.Context is sent as the Stripe-Context header so the object is looked
+// up on that account.
+func (l *Listener) FetchRelatedObject(ctx context.Context, evt V2EventPayload, v interface{}) error {
+	if l.cfgErr != nil {
+		return l.cfgErr
+	}
+	if evt.RelatedObject == nil || evt.RelatedObject.URL == "" {
+		return errors.New("event has no related_object url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", l.cfg.APIBaseURL+evt.RelatedObject.URL, nil)
+	if err != nil {
+		return err
+	}
+	key, err := l.currentAPIKey(ctx)
+	if err != nil {
+		return err
+	}
+	setHeaders(req.Header, key, l.cfg.CLIVersion)
+	req.Header.Del("Content-Type")
+	if l.cfg.APIVersion != "" {
+		req.Header.Set("Stripe-Version", l.cfg.APIVersion)
+	}
+	if evt.Context != "" {
+		req.Header.Set("Stripe-Context", evt.Context)
+	}
+	l.addExtraHeaders(req.Header)
+
+	resp, err := l.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", evt.RelatedObject.URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", evt.RelatedObject.URL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch %s failed (HTTP %d): %s", evt.RelatedObject.URL, resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,104 @@
+package stripelistener
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Stripe-Signature – HMAC-SHA256 over "timestamp.payload"
+// Source: https://github.com/stripe/stripe-cli/blob/master/pkg/proxy/proxy.go
+// Source: https://docs.stripe.com/webhooks#verify-manually
+// ---------------------------------------------------------------------------
+
+// signatureHeader builds a Stripe-Signature header value for payload.
+func signatureHeader(t time.Time, payload []byte, secret string) string {
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(computeSignature(t, payload, secret)))
+}
+
+func computeSignature(t time.Time, payload []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d", t.Unix())))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// DefaultSignatureTolerance is how far the timestamp in a Stripe-Signature
+// header may be from the current time for VerifySignature to accept it,
+// matching Stripe's libraries.
+const DefaultSignatureTolerance = 5 * time.Minute
+
+// Errors returned by VerifySignature.
+var (
+	ErrNoSignature      = errors.New("signature header has no timestamp or v1 signature")
+	ErrSignatureInvalid = errors.New("no v1 signature matches the payload")
+	ErrSignatureExpired = errors.New("signature timestamp outside tolerance")
+)
+
+// WebhookSecret returns the signing secret of the current session, the
+// whsec_... secret Stripe signs events with. It is empty before Authorize.
+func (l *Listener) WebhookSecret() string {
+	if s := l.Session(); s != nil {
+		return s.Secret
+	}
+	return ""
+}
+
+// VerifySignature checks sigHeader, the Stripe-Signature header of an event
+// (see WebhookEvent.Signature), against payload, the raw event JSON, using
+// WebhookSecret. The header's timestamp must be within
+// DefaultSignatureTolerance of the listener's clock.
+func (l *Listener) VerifySignature(payload, sigHeader string) error {
+	secret := l.WebhookSecret()
+	if secret == "" {
+		return errors.New("no session secret; call Authorize first")
+	}
+	return verifySignature([]byte(payload), sigHeader, secret, l.cfg.Clock.Now(), DefaultSignatureTolerance)
+}
+
+// verifySignature implements Stripe's scheme: the header carries t=<unix
+// seconds> and one or more v1=<hex HMAC>, any of which may match.
+func verifySignature(payload []byte, header, secret string, now time.Time, tolerance time.Duration) error {
+	var ts int64 = -1
+	var sigs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("signature timestamp %q: %w", v, err)
+			}
+			ts = n
+		case "v1":
+			if sig, err := hex.DecodeString(v); err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	if ts < 0 || len(sigs) == 0 {
+		return ErrNoSignature
+	}
+
+	t := time.Unix(ts, 0)
+	expected := computeSignature(t, payload, secret)
+	for _, sig := range sigs {
+		if hmac.Equal(sig, expected) {
+			if d := now.Sub(t); d > tolerance || d < -tolerance {
+				return ErrSignatureExpired
+			}
+			return nil
+		}
+	}
+	return ErrSignatureInvalid
+}
@@ -0,0 +1,78 @@
+package stripelistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Sink – JSON-lines dump of every received event
+// ---------------------------------------------------------------------------
+
+// sinkRecord is one line written to Config.Sink.
+type sinkRecord struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Kind       string          `json:"kind"` // "webhook_event" or "v2_event"
+	ReceivedAt time.Time       `json:"received_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// SinkError reports that a record could not be written to Config.Sink.
+type SinkError struct {
+	EventID string
+	Err     error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("sink %s: %v", e.EventID, e.Err)
+}
+
+func (e *SinkError) Unwrap() error { return e.Err }
+
+// eventSink serializes writes to Config.Sink; it is shared by the
+// per-feature listeners.
+type eventSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// write appends one record and flushes w if it has a Flush method, as
+// *bufio.Writer does.
+func (s *eventSink) write(r sinkRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	if f, ok := s.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// dumpEvent writes a received event to Config.Sink, if set.
+func (l *Listener) dumpEvent(id, eventType, kind, payload string, at time.Time) {
+	if l.sink == nil {
+		return
+	}
+	raw := json.RawMessage(payload)
+	if !json.Valid(raw) {
+		// Keep malformed payloads, as a JSON string.
+		raw, _ = json.Marshal(payload)
+	}
+	err := l.sink.write(sinkRecord{ID: id, Type: eventType, Kind: kind, ReceivedAt: at, Payload: raw})
+	if err != nil {
+		l.cfg.Logger.Warnf("sink write failed for %s: %v", id, err)
+		l.reportError(&SinkError{EventID: id, Err: err})
+	}
+}
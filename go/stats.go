@@ -0,0 +1,123 @@
+package stripelistener
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Stats – cheap runtime counters, no metrics backend required
+// ---------------------------------------------------------------------------
+
+// Stats is a point-in-time snapshot of listener counters.
+//
+// Message sizes are measured on complete messages as returned by gorilla's
+// ReadMessage, after any fragmented frames have been reassembled; gorilla
+// does not expose fragmentation or buffer fill levels. As a rule of thumb,
+// an AvgMessageSize well above the dialer's read buffer (4 KiB by default)
+// means most messages need several buffer fills, and a LargestMessage close
+// to ReadLimit means large events are at risk of being rejected.
+type Stats struct {
+	// MessagesReceived counts messages read from the WebSocket.
+	MessagesReceived int64
+
+	// AvgMessageSize is the mean size in bytes of received messages.
+	AvgMessageSize int64
+
+	// LargestMessage is the size in bytes of the biggest message seen.
+	LargestMessage int64
+
+	// ReadLimit is the limit currently applied with SetReadLimit.
+	// Zero means no limit.
+	ReadLimit int64
+
+	// BytesReceived and BytesSent total the message payloads read from and
+	// written to the WebSocket (ACKs, pings, close), excluding frame
+	// headers. They are measured as the application sees them, i.e. before
+	// any compression, which makes them suitable for capacity planning.
+	BytesReceived int64
+	BytesSent     int64
+
+	// EventsReceived counts v1 and v2 events, EventsACKed the ACKs written
+	// for them and ACKFailures the ACKs that could not be written.
+	EventsReceived int64
+	EventsACKed    int64
+	ACKFailures    int64
+
+	// Reconnects counts ListenWithReconnect retries.
+	Reconnects int64
+
+	// PingsSent counts keepalive pings written.
+	PingsSent int64
+
+	// LastEventAt is when the last event was received; zero if none.
+	LastEventAt time.Time
+
+	// ConnectedSince is when the current connection was established; zero
+	// while disconnected. With one connection per feature it reflects the
+	// most recent connect.
+	ConnectedSince time.Time
+}
+
+type statCounters struct {
+	messagesReceived atomic.Int64
+	bytesReceived    atomic.Int64
+	largestMessage   atomic.Int64
+	readLimit        atomic.Int64
+	bytesSent        atomic.Int64
+	eventsReceived   atomic.Int64
+	eventsACKed      atomic.Int64
+	ackFailures      atomic.Int64
+	reconnects       atomic.Int64
+	pingsSent        atomic.Int64
+	lastEventAt      atomic.Int64 // unix nanoseconds
+	connectedSince   atomic.Int64 // unix nanoseconds
+}
+
+func (c *statCounters) recordEvent(at time.Time) {
+	c.eventsReceived.Add(1)
+	c.lastEventAt.Store(at.UnixNano())
+}
+
+func (c *statCounters) recordMessage(size int) {
+	n := int64(size)
+	c.messagesReceived.Add(1)
+	c.bytesReceived.Add(n)
+	for {
+		cur := c.largestMessage.Load()
+		if n <= cur || c.largestMessage.CompareAndSwap(cur, n) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the listener's counters. Safe to call
+// concurrently with Listen.
+func (l *Listener) Stats() Stats {
+	s := Stats{
+		MessagesReceived: l.stats.messagesReceived.Load(),
+		LargestMessage:   l.stats.largestMessage.Load(),
+		ReadLimit:        l.stats.readLimit.Load(),
+		BytesReceived:    l.stats.bytesReceived.Load(),
+		BytesSent:        l.stats.bytesSent.Load(),
+		EventsReceived:   l.stats.eventsReceived.Load(),
+		EventsACKed:      l.stats.eventsACKed.Load(),
+		ACKFailures:      l.stats.ackFailures.Load(),
+		Reconnects:       l.stats.reconnects.Load(),
+		PingsSent:        l.stats.pingsSent.Load(),
+		LastEventAt:      unixNano(l.stats.lastEventAt.Load()),
+		ConnectedSince:   unixNano(l.stats.connectedSince.Load()),
+	}
+	if s.MessagesReceived > 0 {
+		s.AvgMessageSize = s.BytesReceived / s.MessagesReceived
+	}
+	return s
+}
+
+// unixNano converts n to a time, keeping 0 as the zero time.
+func unixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,258 @@
+// Package testutil provides a local stand-in for the Stripe CLI session and
+// WebSocket endpoints, so handlers can be tested without a Stripe account.
+//
+//	srv, cfg := testutil.NewMockServer()
+//	defer srv.Close()
+//	cfg.Handler = myHandler
+//	l := stripelistener.New(cfg)
+//	go l.ListenAll(ctx)
+//	srv.Push(testutil.WebhookEventFrame("evt_1", `{"id":"evt_1","type":"customer.created","data":{"object":{}}}`))
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	stripelistener "github.com/kmoz000/stripelistener/go"
+)
+
+const (
+	sessionPath   = "/v1/stripecli/sessions"
+	websocketPath = "/ws"
+
+	// Secret is the signing secret returned in every mock session.
+	Secret = "whsec_test_mock"
+)
+
+// MockServer serves the session endpoint and a WebSocket endpoint. Frames
+// passed to Push are written, in order, to whichever client is connected.
+type MockServer struct {
+	srv    *httptest.Server
+	frames chan []byte
+
+	mu           sync.Mutex
+	received     [][]byte
+	sessions     int
+	open         int
+	conns        map[*ws.Conn]struct{}
+	subprotocols []string
+	delay        int
+	expired      int // sessions up to this number are refused
+}
+
+// NewMockServer starts a server and returns it with a Config pointing at
+// it. Set a handler on the Config before passing it to stripelistener.New.
+func NewMockServer() (*MockServer, stripelistener.Config) {
+	s := &MockServer{
+		frames:       make(chan []byte, 256),
+		conns:        make(map[*ws.Conn]struct{}),
+		subprotocols: []string{stripelistener.Subprotocol},
+		delay:        1,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(sessionPath, s.handleSession)
+	mux.HandleFunc(websocketPath, s.handleWebSocket)
+	s.srv = httptest.NewServer(mux)
+
+	cfg := stripelistener.Config{
+		APIKey:     "sk_test_mock",
+		APIBaseURL: s.srv.URL,
+	}
+	return s, cfg
+}
+
+// URL returns the server's base URL.
+func (s *MockServer) URL() string {
+	return s.srv.URL
+}
+
+// Push queues a raw frame for the connected client. Frames pushed before a
+// client connects are delivered once it does. Push blocks when 256 frames
+// are already queued.
+func (s *MockServer) Push(frame []byte) {
+	s.frames <- frame
+}
+
+// Received returns the frames clients have sent so far, such as ACKs.
+func (s *MockServer) Received() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.received...)
+}
+
+// Sessions returns how many sessions have been created.
+func (s *MockServer) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+// OpenConnections returns how many WebSocket clients are connected right
+// now, e.g. to check that a test leaves none behind.
+func (s *MockServer) OpenConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open
+}
+
+// ExpireSessions makes the WebSocket endpoint refuse every session created
+// so far with HTTP 401, as Stripe does for a session it no longer accepts.
+func (s *MockServer) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired = s.sessions
+}
+
+// SetReconnectDelay sets the reconnect_delay, in seconds, returned in later
+// sessions. It defaults to 1.
+func (s *MockServer) SetReconnectDelay(seconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = seconds
+}
+
+// SetSubprotocols replaces the WebSocket subprotocols the server agrees to,
+// which default to stripelistener.Subprotocol. It applies to later
+// connections.
+func (s *MockServer) SetSubprotocols(protocols ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subprotocols = append([]string(nil), protocols...)
+}
+
+// Disconnect closes every open WebSocket connection with the given close
+// code and text, e.g. ws.CloseServiceRestart, as Stripe does when it drops
+// a client.
+func (s *MockServer) Disconnect(code int, text string) {
+	s.mu.Lock()
+	conns := make([]*ws.Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	msg := ws.FormatCloseMessage(code, text)
+	for _, c := range conns {
+		_ = c.WriteControl(ws.CloseMessage, msg, time.Now().Add(time.Second))
+		c.Close()
+	}
+}
+
+// Close shuts the server down and drops open connections.
+func (s *MockServer) Close() {
+	s.srv.CloseClientConnections()
+	s.srv.Close()
+}
+
+func (s *MockServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	feature := r.PostForm.Get("websocket_features[]")
+	if feature == "" {
+		feature = stripelistener.FeatureWebhooks
+	}
+
+	s.mu.Lock()
+	s.sessions++
+	id := fmt.Sprintf("mock_ws_%d", s.sessions)
+	delay := s.delay
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stripelistener.Session{
+		ReconnectDelay:             delay,
+		Secret:                     Secret,
+		WebSocketAuthorizedFeature: feature,
+		WebSocketID:                id,
+		WebSocketURL:               "ws" + strings.TrimPrefix(s.srv.URL, "http") + websocketPath,
+	})
+}
+
+func (s *MockServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var n int
+	fmt.Sscanf(r.Header.Get("Websocket-Id"), "mock_ws_%d", &n)
+	s.mu.Lock()
+	up := ws.Upgrader{Subprotocols: s.subprotocols}
+	expired := n <= s.expired
+	s.mu.Unlock()
+	if expired {
+		http.Error(w, "session expired", http.StatusUnauthorized)
+		return
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.mu.Lock()
+	s.open++
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.open--
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	// Ping/pong and close frames are handled inside ReadMessage.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received = append(s.received, data)
+			s.mu.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case frame := <-s.frames:
+			if err := conn.WriteMessage(ws.TextMessage, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// WebhookEventFrame builds a webhook_event frame around payload, the JSON
+// of a Stripe event, with placeholder conversation and webhook IDs.
+func WebhookEventFrame(eventID, payload string) []byte {
+	b, _ := json.Marshal(stripelistener.WebhookEvent{
+		Type:                  stripelistener.MsgTypeWebhookEvent,
+		EventPayload:          payload,
+		HTTPHeaders:           map[string]string{"Content-Type": "application/json; charset=utf-8"},
+		WebhookConversationID: "wc_" + eventID,
+		WebhookID:             "we_" + eventID,
+	})
+	return b
+}
+
+// V2EventFrame builds a v2_event frame around payload, the JSON of a thin
+// event.
+func V2EventFrame(payload string) []byte {
+	b, _ := json.Marshal(stripelistener.V2Event{
+		Type:               stripelistener.MsgTypeV2Event,
+		Payload:            payload,
+		EventDestinationID: "ed_mock",
+	})
+	return b
+}
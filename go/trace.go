@@ -0,0 +1,57 @@
+package stripelistener
+
+import (
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// TraceEvent – targeted verbose logging for a single event
+// ---------------------------------------------------------------------------
+
+type tracer struct {
+	mu      sync.Mutex
+	pending map[string]time.Time // event ID -> expiry (zero = none)
+}
+
+// TraceEvent enables verbose logging (raw frame, parsed payload, ACK) for
+// the event with the given ID only. Tracing stops once that event has been
+// seen, or after ttl if it never arrives; a zero ttl waits indefinitely.
+//
+// Events are matched on the ID parsed from the inner payload, so a frame
+// whose payload fails to parse cannot be traced. Trace output goes through
+// Logger.Infof regardless of the logger's own level.
+func (l *Listener) TraceEvent(eventID string, ttl time.Duration) {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = l.cfg.Clock.Now().Add(ttl)
+	}
+
+	l.trace.mu.Lock()
+	defer l.trace.mu.Unlock()
+	if l.trace.pending == nil {
+		l.trace.pending = make(map[string]time.Time)
+	}
+	l.trace.pending[eventID] = expiry
+}
+
+// take reports whether eventID, received at now, is being traced and, if
+// so, stops tracing it.
+func (t *tracer) take(eventID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return false
+	}
+
+	for id, expiry := range t.pending {
+		if !expiry.IsZero() && now.After(expiry) {
+			delete(t.pending, id)
+		}
+	}
+	if _, ok := t.pending[eventID]; !ok {
+		return false
+	}
+	delete(t.pending, eventID)
+	return true
+}
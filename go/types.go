@@ -1,6 +1,10 @@
 package stripelistener
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
 
 // --- Session (from POST /v1/stripecli/sessions) ---
 
@@ -14,8 +18,39 @@ type Session struct {
 	WebSocketURL               string `json:"websocket_url"`
 	DefaultVersion             string `json:"default_version"`
 	LatestVersion              string `json:"latest_version"`
+
+	// RequestID is the Request-Id header of the authorize response. It is
+	// not part of the response body.
+	RequestID string `json:"-"`
 }
 
+// --- Message types and features ---
+
+// Message types carried in the "type" field of WebSocket frames.
+// Source: https://github.com/stripe/stripe-cli/blob/master/pkg/websocket/messages.go
+const (
+	MsgTypeWebhookEvent    = "webhook_event"
+	MsgTypeV2Event         = "v2_event"
+	MsgTypeRequestLogEvent = "request_log_event"
+	MsgTypeEventAck        = "event_ack"
+	MsgTypeWebhookResponse = "webhook_response"
+)
+
+// WebSocket features that can be requested through Config.WebSocketFeatures.
+const (
+	FeatureWebhooks    = "webhooks"
+	FeatureRequestLogs = "request_logs"
+
+	// FeatureThinEvents is the feature thin (v2) events arrive on. Stripe
+	// sends them as v2_event messages alongside v1 events on the webhooks
+	// feature, so it is another name for FeatureWebhooks: request one or
+	// the other, not both.
+	FeatureThinEvents = FeatureWebhooks
+)
+
+// Subprotocol is the WebSocket subprotocol the Stripe CLI negotiates.
+const Subprotocol = "stripecli-devproxy-v1"
+
 // --- Incoming WebSocket messages ---
 
 // WebhookEndpoint describes the fake endpoint attached to the event.
@@ -32,6 +67,45 @@ type WebhookEvent struct {
 	Type                  string            `json:"type"`
 	WebhookConversationID string            `json:"webhook_conversation_id"`
 	WebhookID             string            `json:"webhook_id"`
+
+	// ReceivedAt is when the listener read the event. It is not part of
+	// the message.
+	ReceivedAt time.Time `json:"-"`
+
+	origin *Listener // the Listener that read the event, for ACK
+}
+
+// Latency returns how long after its creation the event was received:
+// ReceivedAt minus parsed.Created. created has one-second resolution and
+// comes from Stripe's clock, so expect a second of noise plus any skew
+// between the two clocks.
+func (e WebhookEvent) Latency(parsed StripeEventPayload) time.Duration {
+	return e.ReceivedAt.Sub(time.Unix(parsed.Created, 0))
+}
+
+// Header returns the value of the named HTTP header Stripe attached to the
+// event, or "". HTTPHeaders is a plain map whose keys may be in any case,
+// so the name is matched case-insensitively.
+func (e WebhookEvent) Header(name string) string {
+	if v, ok := e.HTTPHeaders[name]; ok {
+		return v
+	}
+	for k, v := range e.HTTPHeaders {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Signature returns the Stripe-Signature header attached to the event.
+func (e WebhookEvent) Signature() string {
+	return e.Header("Stripe-Signature")
+}
+
+// RequestID returns the Request-Id header attached to the event, if any.
+func (e WebhookEvent) RequestID() string {
+	return e.Header("Request-Id")
 }
 
 // V2Event is a v2 thin event pushed over the WebSocket.
@@ -41,6 +115,19 @@ type V2Event struct {
 	HTTPHeaders        map[string]string `json:"http_headers"`
 	Payload            string            `json:"payload"`
 	EventDestinationID string            `json:"destination_id"`
+
+	// ReceivedAt is when the listener read the event. It is not part of
+	// the message.
+	ReceivedAt time.Time `json:"-"`
+
+	origin *Listener // the Listener that read the event, for ACK
+}
+
+// Latency returns how long after its creation the event was received:
+// ReceivedAt minus parsed.Created, subject to skew between Stripe's clock
+// and the local one.
+func (e V2Event) Latency(parsed V2EventPayload) time.Duration {
+	return e.ReceivedAt.Sub(parsed.Created)
 }
 
 // IncomingMessage is a polymorphic envelope for all WebSocket messages.
@@ -63,16 +150,40 @@ func (m *IncomingMessage) UnmarshalJSON(data []byte) error {
 	m.RawData = data
 
 	switch typeOnly.Type {
-	case "webhook_event":
+	case MsgTypeWebhookEvent:
 		m.WebhookEvent = &WebhookEvent{}
 		return json.Unmarshal(data, m.WebhookEvent)
-	case "v2_event":
+	case MsgTypeV2Event:
 		m.V2Event = &V2Event{}
 		return json.Unmarshal(data, m.V2Event)
 	}
 	return nil
 }
 
+// UnknownMessage is a message of a type the listener doesn't handle, as
+// passed to UnknownMessageHandler.
+type UnknownMessage struct {
+	Type string
+
+	// ID is the top-level "id" field, if the message has a string one.
+	ID string
+
+	// Fields holds the top-level fields of the message, decoded as by
+	// encoding/json. Nil if the message is not a JSON object.
+	Fields map[string]interface{}
+
+	// Raw is the message exactly as received.
+	Raw json.RawMessage
+}
+
+func newUnknownMessage(rawType string, raw json.RawMessage) UnknownMessage {
+	m := UnknownMessage{Type: rawType, Raw: raw}
+	if json.Unmarshal(raw, &m.Fields) == nil {
+		m.ID, _ = m.Fields["id"].(string)
+	}
+	return m
+}
+
 // --- Outgoing WebSocket messages ---
 
 // EventAck acknowledges receipt of an event.
@@ -84,6 +195,24 @@ type EventAck struct {
 	WebhookID             string `json:"webhook_id"`
 }
 
+// WebhookResponse reports to Stripe how a forwarded event was answered by
+// the local endpoint, so the delivery attempt and its status code show up
+// in the Dashboard. It is sent in addition to the EventAck, which only
+// confirms receipt and carries no outcome.
+// Source: https://github.com/stripe/stripe-cli/blob/master/pkg/websocket/webhook_messages.go
+type WebhookResponse struct {
+	ForwardURL            string            `json:"forward_url"`
+	Status                int               `json:"status"`
+	HTTPHeaders           map[string]string `json:"http_headers"`
+	Body                  string            `json:"body"`
+	Type                  string            `json:"type"`
+	WebhookConversationID string            `json:"webhook_conversation_id"`
+	WebhookID             string            `json:"webhook_id"`
+	RequestHeaders        map[string]string `json:"request_headers"`
+	RequestBody           string            `json:"request_body"`
+	NotifyMissingSecret   bool              `json:"notify_missing_secret"`
+}
+
 // --- Parsed inner event payload ---
 
 // StripeEventPayload is the parsed JSON inside WebhookEvent.EventPayload.
@@ -94,11 +223,52 @@ type StripeEventPayload struct {
 	Livemode        bool                   `json:"livemode"`
 	APIVersion      string                 `json:"api_version"`
 	PendingWebhooks int                    `json:"pending_webhooks"`
+	Account         string                 `json:"account,omitempty"` // set for Connect events
 	Data            map[string]interface{} `json:"data"`
+
+	rawData json.RawMessage // `data` as received, for DataObject
+}
+
+func (p *StripeEventPayload) UnmarshalJSON(data []byte) error {
+	type plain StripeEventPayload
+	aux := struct {
+		*plain
+		Data json.RawMessage `json:"data"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	p.rawData = aux.Data
+	p.Data = nil
+	if len(aux.Data) > 0 {
+		return json.Unmarshal(aux.Data, &p.Data)
+	}
+	return nil
 }
 
 // V2EventPayload is the parsed JSON inside V2Event.Payload.
+// Unlike v1 payloads, v2 events carry `created` as an RFC 3339 timestamp
+// rather than Unix seconds.
 type V2EventPayload struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Created  time.Time `json:"created"`
+	Livemode bool      `json:"livemode"`
+
+	// Context is the account the event happened on, for events from
+	// connected accounts. Empty otherwise.
+	Context string `json:"context,omitempty"`
+
+	// RelatedObject points at the object the event is about. Thin events
+	// carry no object data; fetch it from RelatedObject.URL. Nil for events
+	// without a related object.
+	RelatedObject *V2RelatedObject `json:"related_object,omitempty"`
+}
+
+// V2RelatedObject identifies the object a v2 event refers to.
+type V2RelatedObject struct {
 	ID   string `json:"id"`
 	Type string `json:"type"`
-}
\ No newline at end of file
+	URL  string `json:"url"` // API path, e.g. /v1/billing/meters/mtr_123
+}
@@ -0,0 +1,96 @@
+package stripelistener
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Worker pool – concurrent handler dispatch (Config.Concurrency)
+// ---------------------------------------------------------------------------
+
+// workerPool runs handler calls on Config.Concurrency goroutines. Without
+// PreserveOrderByObject all workers share one queue; with it every worker
+// has its own queue and jobs are routed by a hash of the object ID.
+type workerPool struct {
+	queues []chan func()
+	full   bool // a full queue has been reported since the last success
+}
+
+func newWorkerPool(n, queueSize int, perWorker bool) *workerPool {
+	p := &workerPool{queues: make([]chan func(), n)}
+	shared := make(chan func(), queueSize)
+	for i := range p.queues {
+		if perWorker {
+			p.queues[i] = make(chan func(), queueSize)
+		} else {
+			p.queues[i] = shared
+		}
+	}
+	return p
+}
+
+// start launches the workers. Each exits once its queue is closed and
+// drained.
+func (p *workerPool) start(wg *sync.WaitGroup) {
+	for _, q := range p.queues {
+		wg.Add(1)
+		go func(q chan func()) {
+			defer wg.Done()
+			for job := range q {
+				job()
+			}
+		}(q)
+	}
+}
+
+// close stops accepting jobs; queued jobs still run.
+func (p *workerPool) close() {
+	closed := make(map[chan func()]bool, len(p.queues))
+	for _, q := range p.queues {
+		if !closed[q] {
+			close(q)
+			closed[q] = true
+		}
+	}
+}
+
+// dispatch runs job inline when there is no worker pool, and otherwise
+// queues it. key selects the worker when ordering per object is enabled.
+// When the queue is full the read loop blocks until a worker frees a slot,
+// which stops reading from Stripe until handlers catch up. It blocks even
+// while Listen shuts down, since the event may already be ACKed and the
+// workers keep draining the queue until stopPipeline closes it.
+func (l *Listener) dispatch(key string, handle func()) {
+	job := func() {
+		start := time.Now()
+		handle()
+		l.cfg.Metrics.ObserveHandlerDuration(time.Since(start))
+	}
+
+	p := l.workers
+	if p == nil {
+		job()
+		return
+	}
+
+	q := p.queues[0]
+	if l.cfg.PreserveOrderByObject && key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		q = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+
+	select {
+	case q <- job:
+		p.full = false
+		return
+	default:
+	}
+	if !p.full {
+		p.full = true
+		l.cfg.Logger.Warnf("handler queue full (%d); pausing reads until workers catch up", cap(q))
+	}
+	q <- job
+}